@@ -23,7 +23,7 @@ forwarders:
     rules:
       - city: beijing,chengdu
         allowed: true
-      - ip: 0.0.0.0/0
+      - ip: any
         allowed: false
 #  - protocol: udp
 #    addr: ":54321"
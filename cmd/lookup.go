@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/internal/meteor"
+	"github.com/dushxiiang/meteor/pkg/logger"
+
+	"github.com/spf13/cobra"
+)
+
+var lookupCmd = &cobra.Command{
+	Use:   "lookup <ip>",
+	Short: "Show the location of an ip and the verdict of every forwarder",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger.Init(debug)
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			fmt.Printf("invalid ip address: %s\n", args[0])
+			return
+		}
+		m, err := meteor.New(config)
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+			return
+		}
+		if err := m.InitLocationService(); err != nil {
+			fmt.Printf("warn: %v\n", err)
+		}
+
+		fmt.Printf("IP:           %s\n", ip)
+		if m.Location == nil {
+			fmt.Printf("Location:     not configured\n")
+		} else if info, err := m.Location.Lookup(ip); err != nil {
+			fmt.Printf("Location:     %v\n", err)
+		} else {
+			printInfo(info)
+		}
+
+		var banned bool
+		if bans := m.Bans(); bans != nil {
+			fmt.Printf("\nBan:\n")
+			if ban, ok := bans.Ban(ip); ok {
+				banned = true
+				fmt.Printf("  banned until %s, %d denials, reason: %s\n", ban.Until.Format(time.DateTime), ban.Count, ban.Reason)
+			} else {
+				fmt.Printf("  not banned\n")
+			}
+		}
+
+		var listed bool
+		if m.Intel != nil {
+			m.Intel.Load()
+			fmt.Printf("\nThreat intel:\n")
+			if feed, ok := m.Intel.Listed(ip); ok {
+				listed = true
+				fmt.Printf("  listed by %s\n", feed)
+			} else {
+				fmt.Printf("  not listed\n")
+			}
+			for _, stats := range m.Intel.Stats() {
+				fmt.Printf("  feed %s: %d entries, last refresh: %s, last error: %s\n",
+					stats.Name, stats.Entries, stats.LastRefresh.Format(time.DateTime), stats.LastError)
+			}
+		}
+
+		fmt.Printf("\nForwarders:\n")
+		for i, forwarder := range m.Forwarders() {
+			index, allowed := forwarder.Rules.Match(ip, m.Location)
+			verdict := "denied"
+			if allowed {
+				verdict = "allowed"
+			}
+			matched := "no rule matched"
+			if index >= 0 {
+				matched = fmt.Sprintf("matched rule #%d", index)
+			}
+			// the bans and the threat intel are checked before the rules
+			if banned {
+				verdict, matched = "denied", "banned"
+			} else if listed {
+				verdict, matched = "denied", "listed by threat intel"
+			}
+			if forwarder.DryRun {
+				matched += ", dry run"
+			}
+			fmt.Printf("  [%d] %s %s -> %s: %s, %s\n", i, forwarder.Protocol, forwarder.Addr, strings.Join(forwarder.To, ","), verdict, matched)
+		}
+	},
+}
+
+func printInfo(info *location.Info) {
+	fmt.Printf("City:         %s\n", formatPlace(info.City))
+	for _, subdivision := range info.Subdivisions {
+		fmt.Printf("Subdivision:  %s\n", formatPlace(subdivision))
+	}
+	fmt.Printf("Country:      %s\n", formatPlace(info.Country))
+	fmt.Printf("Continent:    %s\n", formatPlace(info.Continent))
+	if info.ASN > 0 {
+		fmt.Printf("ASN:          AS%d\n", info.ASN)
+	}
+	fmt.Printf("Org:          %s\n", info.Org)
+	fmt.Printf("ISP:          %s\n", info.ISP)
+	fmt.Printf("Labels:       %s\n", strings.Join(info.Labels, ","))
+}
+
+func formatPlace(place location.Place) string {
+	var keys []string
+	for lang := range place.Names {
+		keys = append(keys, lang)
+	}
+	sort.Strings(keys)
+	var names []string
+	for _, lang := range keys {
+		names = append(names, lang+"="+place.Names[lang])
+	}
+	if place.Code == "" {
+		return strings.Join(names, ", ")
+	}
+	if len(names) == 0 {
+		return place.Code
+	}
+	return fmt.Sprintf("%s (%s)", place.Code, strings.Join(names, ", "))
+}
@@ -0,0 +1,143 @@
+package location
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewCacheLocation caches at most size results of the provider for ttl, the least recently used result is evicted first.
+func NewCacheLocation(provider Location, size int, ttl time.Duration) *CacheLocation {
+	return &CacheLocation{
+		provider: provider,
+		size:     size,
+		ttl:      ttl,
+		items:    make(map[[net.IPv6len]byte]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+type CacheLocation struct {
+	provider Location
+	size     int
+	ttl      time.Duration
+
+	mutex sync.Mutex
+	items map[[net.IPv6len]byte]*list.Element
+	lru   *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheItem struct {
+	key      [net.IPv6len]byte
+	info     *Info
+	expireAt time.Time
+}
+
+type CacheStats struct {
+	Size   int
+	Hits   uint64
+	Misses uint64
+}
+
+func (r *CacheLocation) Lookup(ip net.IP) (*Info, error) {
+	var key [net.IPv6len]byte
+	copy(key[:], ip.To16())
+
+	if info, ok := r.get(key); ok {
+		r.hits.Add(1)
+		return info, nil
+	}
+	r.misses.Add(1)
+
+	info, err := r.provider.Lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+	r.set(key, info)
+	return info, nil
+}
+
+func (r *CacheLocation) get(key [net.IPv6len]byte) (*Info, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	element, ok := r.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*cacheItem)
+	if time.Now().After(item.expireAt) {
+		r.lru.Remove(element)
+		delete(r.items, key)
+		return nil, false
+	}
+	r.lru.MoveToFront(element)
+	return item.info, true
+}
+
+func (r *CacheLocation) set(key [net.IPv6len]byte, info *Info) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if element, ok := r.items[key]; ok {
+		item := element.Value.(*cacheItem)
+		item.info = info
+		item.expireAt = time.Now().Add(r.ttl)
+		r.lru.MoveToFront(element)
+		return
+	}
+	r.items[key] = r.lru.PushFront(&cacheItem{
+		key:      key,
+		info:     info,
+		expireAt: time.Now().Add(r.ttl),
+	})
+	for r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.items, oldest.Value.(*cacheItem).key)
+	}
+}
+
+// Purge removes all cached results, for example after the underlying database has been reloaded.
+func (r *CacheLocation) Purge() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.items = make(map[[net.IPv6len]byte]*list.Element)
+	r.lru.Init()
+}
+
+// Reload reloads the provider and purges the cached results.
+func (r *CacheLocation) Reload() error {
+	reloadable, ok := r.provider.(Reloadable)
+	if !ok {
+		return nil
+	}
+	if err := reloadable.Reload(); err != nil {
+		return err
+	}
+	r.Purge()
+	return nil
+}
+
+func (r *CacheLocation) Files() []string {
+	if reloadable, ok := r.provider.(Reloadable); ok {
+		return reloadable.Files()
+	}
+	return nil
+}
+
+func (r *CacheLocation) Stats() CacheStats {
+	r.mutex.Lock()
+	size := r.lru.Len()
+	r.mutex.Unlock()
+	return CacheStats{
+		Size:   size,
+		Hits:   r.hits.Load(),
+		Misses: r.misses.Load(),
+	}
+}
+
+var _ Reloadable = (*CacheLocation)(nil)
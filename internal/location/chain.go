@@ -0,0 +1,100 @@
+package location
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NewChainLocation looks up the ip in every provider in order and merges the results,
+// a later provider only fills the fields an earlier one left empty.
+func NewChainLocation(providers ...Location) Location {
+	return &chainLocation{
+		providers: providers,
+	}
+}
+
+type chainLocation struct {
+	providers []Location
+}
+
+func (r chainLocation) Lookup(ip net.IP) (*Info, error) {
+	var (
+		info     Info
+		found    bool
+		messages []string
+	)
+	for _, provider := range r.providers {
+		item, err := provider.Lookup(ip)
+		if err != nil {
+			messages = append(messages, err.Error())
+			continue
+		}
+		found = true
+		info.Merge(item)
+	}
+	if !found && len(messages) > 0 {
+		return nil, errors.New(strings.Join(messages, "; "))
+	}
+	return &info, nil
+}
+
+// Reload reloads every reloadable provider.
+func (r chainLocation) Reload() error {
+	var messages []string
+	for _, provider := range r.providers {
+		if reloadable, ok := provider.(Reloadable); ok {
+			if err := reloadable.Reload(); err != nil {
+				messages = append(messages, err.Error())
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+func (r chainLocation) Files() []string {
+	var files []string
+	for _, provider := range r.providers {
+		if reloadable, ok := provider.(Reloadable); ok {
+			files = append(files, reloadable.Files()...)
+		}
+	}
+	return files
+}
+
+// Merge fills the empty fields of r with the fields of other.
+func (r *Info) Merge(other *Info) {
+	r.City.merge(other.City)
+	if len(r.Subdivisions) == 0 {
+		r.Subdivisions = other.Subdivisions
+	}
+	r.Country.merge(other.Country)
+	r.Continent.merge(other.Continent)
+	if r.ASN == 0 {
+		r.ASN = other.ASN
+	}
+	if r.Org == "" {
+		r.Org = other.Org
+	}
+	if r.ISP == "" {
+		r.ISP = other.ISP
+	}
+	if len(r.Labels) == 0 {
+		r.Labels = other.Labels
+	}
+}
+
+func (r *Place) merge(other Place) {
+	if r.Code == "" {
+		r.Code = other.Code
+	}
+	if len(r.Names) == 0 {
+		r.Names = other.Names
+	}
+}
+
+var _ Reloadable = (*chainLocation)(nil)
@@ -3,29 +3,115 @@ package location
 import (
 	"github.com/oschwald/geoip2-golang"
 	"net"
+	"sync"
 )
 
-func NewGeoIPLocation(file string) (Location, error) {
-	ipdb, err := geoip2.Open(file)
-	if err != nil {
-		return nil, err
-	}
+// NewGeoIPLocation opens the GeoLite2 City database and the optional GeoLite2 ASN database,
+// either of the files may be empty.
+func NewGeoIPLocation(file, asnFile string) (Location, error) {
 	location := geoIPLocation{
-		ipdb: ipdb,
+		file:    file,
+		asnFile: asnFile,
+	}
+	if err := location.Reload(); err != nil {
+		return nil, err
 	}
 	return &location, nil
 }
 
 type geoIPLocation struct {
-	ipdb *geoip2.Reader
+	file    string
+	asnFile string
+
+	mutex sync.RWMutex
+	ipdb  *geoip2.Reader
+	asndb *geoip2.Reader
 }
 
-func (r geoIPLocation) City(ip net.IP) (map[string]string, error) {
-	city, err := r.ipdb.City(ip)
-	if err != nil {
-		return nil, err
+func (r *geoIPLocation) Lookup(ip net.IP) (*Info, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var info Info
+	if r.ipdb != nil {
+		city, err := r.ipdb.City(ip)
+		if err != nil {
+			return nil, err
+		}
+		info.City = Place{
+			Names: city.City.Names,
+		}
+		info.Country = Place{
+			Code:  city.Country.IsoCode,
+			Names: city.Country.Names,
+		}
+		info.Continent = Place{
+			Code:  city.Continent.Code,
+			Names: city.Continent.Names,
+		}
+		for _, subdivision := range city.Subdivisions {
+			info.Subdivisions = append(info.Subdivisions, Place{
+				Code:  subdivision.IsoCode,
+				Names: subdivision.Names,
+			})
+		}
+	}
+	if r.asndb != nil {
+		asn, err := r.asndb.ASN(ip)
+		if err != nil {
+			return nil, err
+		}
+		info.ASN = asn.AutonomousSystemNumber
+		info.Org = asn.AutonomousSystemOrganization
+	}
+	return &info, nil
+}
+
+// Reload opens the database files again and swaps them in,
+// the old readers are closed after the in-flight lookups finish.
+func (r *geoIPLocation) Reload() error {
+	var ipdb, asndb *geoip2.Reader
+	if r.file != "" {
+		reader, err := geoip2.Open(r.file)
+		if err != nil {
+			return err
+		}
+		ipdb = reader
+	}
+	if r.asnFile != "" {
+		reader, err := geoip2.Open(r.asnFile)
+		if err != nil {
+			if ipdb != nil {
+				_ = ipdb.Close()
+			}
+			return err
+		}
+		asndb = reader
+	}
+
+	r.mutex.Lock()
+	oldIPDB, oldASNDB := r.ipdb, r.asndb
+	r.ipdb, r.asndb = ipdb, asndb
+	r.mutex.Unlock()
+
+	if oldIPDB != nil {
+		_ = oldIPDB.Close()
+	}
+	if oldASNDB != nil {
+		_ = oldASNDB.Close()
+	}
+	return nil
+}
+
+func (r *geoIPLocation) Files() []string {
+	var files []string
+	if r.file != "" {
+		files = append(files, r.file)
+	}
+	if r.asnFile != "" {
+		files = append(files, r.asnFile)
 	}
-	return city.City.Names, err
+	return files
 }
 
-var _ Location = (*geoIPLocation)(nil)
+var _ Reloadable = (*geoIPLocation)(nil)
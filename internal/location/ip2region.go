@@ -0,0 +1,127 @@
+package location
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	xdbHeaderLength      = 256
+	xdbVectorIndexCols   = 256
+	xdbVectorIndexSize   = 8
+	xdbSegmentIndexSize  = 14
+	xdbVectorIndexLength = xdbVectorIndexCols * xdbVectorIndexCols * xdbVectorIndexSize
+)
+
+// NewIP2RegionLocation loads the ip2region xdb file into memory,
+// the region of the xdb file is formatted as 国家|区域|省份|城市|ISP.
+func NewIP2RegionLocation(file string) (Location, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < xdbHeaderLength+xdbVectorIndexLength {
+		return nil, errors.Errorf("invalid ip2region xdb file %s", file)
+	}
+	location := ip2RegionLocation{
+		content: content,
+	}
+	return &location, nil
+}
+
+type ip2RegionLocation struct {
+	content []byte
+}
+
+func (r ip2RegionLocation) Lookup(ip net.IP) (*Info, error) {
+	var info Info
+	ip4 := ip.To4()
+	if ip4 == nil {
+		// xdb only contains IPv4 addresses
+		return &info, nil
+	}
+	region, err := r.search(binary.BigEndian.Uint32(ip4))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(region, "|")
+	for len(fields) < 5 {
+		fields = append(fields, "0")
+	}
+	if country := xdbField(fields[0]); country != "" {
+		info.Country = Place{Names: map[string]string{"zh-CN": country}}
+	}
+	if province := xdbField(fields[2]); province != "" {
+		info.Subdivisions = []Place{{Names: chineseNames(province)}}
+	}
+	if city := xdbField(fields[3]); city != "" {
+		info.City = Place{Names: chineseNames(city)}
+	}
+	info.ISP = xdbField(fields[4])
+	return &info, nil
+}
+
+func (r ip2RegionLocation) search(ip uint32) (string, error) {
+	il0, il1 := ip>>24&0xFF, ip>>16&0xFF
+	offset := xdbHeaderLength + int(il0*xdbVectorIndexCols*xdbVectorIndexSize+il1*xdbVectorIndexSize)
+	sPtr := binary.LittleEndian.Uint32(r.content[offset:])
+	ePtr := binary.LittleEndian.Uint32(r.content[offset+4:])
+	if sPtr == 0 || ePtr < sPtr {
+		return "", nil
+	}
+
+	var dataLen, dataPtr uint32
+	l, h := 0, int((ePtr-sPtr)/xdbSegmentIndexSize)
+	for l <= h {
+		m := (l + h) >> 1
+		p := int(sPtr) + m*xdbSegmentIndexSize
+		if p+xdbSegmentIndexSize > len(r.content) {
+			return "", errors.New("invalid ip2region segment index")
+		}
+		segment := r.content[p : p+xdbSegmentIndexSize]
+		if ip < binary.LittleEndian.Uint32(segment) {
+			h = m - 1
+		} else if ip > binary.LittleEndian.Uint32(segment[4:]) {
+			l = m + 1
+		} else {
+			dataLen = uint32(binary.LittleEndian.Uint16(segment[8:]))
+			dataPtr = binary.LittleEndian.Uint32(segment[10:])
+			break
+		}
+	}
+	if dataLen == 0 {
+		return "", nil
+	}
+	if int(dataPtr+dataLen) > len(r.content) {
+		return "", errors.New("invalid ip2region data pointer")
+	}
+	return string(r.content[dataPtr : dataPtr+dataLen]), nil
+}
+
+func xdbField(field string) string {
+	if field == "0" {
+		return ""
+	}
+	return field
+}
+
+var chineseRegionSuffixes = []string{"维吾尔自治区", "壮族自治区", "回族自治区", "特别行政区", "自治区", "自治州", "省", "市"}
+
+// chineseNames returns the full name and the name without the administrative suffix, e.g. 成都市 and 成都.
+func chineseNames(name string) map[string]string {
+	names := map[string]string{"zh-CN": name}
+	for _, suffix := range chineseRegionSuffixes {
+		if short := strings.TrimSuffix(name, suffix); short != name && short != "" {
+			names["zh"] = short
+			break
+		}
+	}
+	return names
+}
+
+var _ Location = (*ip2RegionLocation)(nil)
@@ -0,0 +1,138 @@
+package location
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type xdbSegment struct {
+	start, end string
+	region     string
+}
+
+// buildXDB builds the content of an xdb file, the segments must be sorted and must not cross a /16 block.
+func buildXDB(segments []xdbSegment) []byte {
+	content := make([]byte, xdbHeaderLength+xdbVectorIndexLength)
+	var dataPtrs []uint32
+	for _, segment := range segments {
+		dataPtrs = append(dataPtrs, uint32(len(content)))
+		content = append(content, segment.region...)
+	}
+	for i, segment := range segments {
+		start := binary.BigEndian.Uint32(net.ParseIP(segment.start).To4())
+		end := binary.BigEndian.Uint32(net.ParseIP(segment.end).To4())
+		ptr := uint32(len(content))
+		content = binary.LittleEndian.AppendUint32(content, start)
+		content = binary.LittleEndian.AppendUint32(content, end)
+		content = binary.LittleEndian.AppendUint16(content, uint16(len(segment.region)))
+		content = binary.LittleEndian.AppendUint32(content, dataPtrs[i])
+
+		offset := xdbHeaderLength + int(start>>24&0xFF)*xdbVectorIndexCols*xdbVectorIndexSize + int(start>>16&0xFF)*xdbVectorIndexSize
+		if binary.LittleEndian.Uint32(content[offset:]) == 0 {
+			binary.LittleEndian.PutUint32(content[offset:], ptr)
+		}
+		binary.LittleEndian.PutUint32(content[offset+4:], ptr)
+	}
+	return content
+}
+
+func writeXDB(t *testing.T, content []byte) string {
+	file := filepath.Join(t.TempDir(), "ip2region.xdb")
+	if err := os.WriteFile(file, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestIP2RegionLocation(t *testing.T) {
+	provider, err := NewIP2RegionLocation(writeXDB(t, buildXDB([]xdbSegment{
+		{start: "1.2.0.0", end: "1.2.3.255", region: "中国|0|四川省|成都市|电信"},
+		{start: "1.2.4.0", end: "1.2.4.255", region: "中国|0|新疆维吾尔自治区|乌鲁木齐市|联通"},
+		{start: "1.2.8.0", end: "1.2.255.255", region: "中国|0|0|0|0"},
+		{start: "8.8.0.0", end: "8.8.255.255", region: "美国|0|0|0|Level3"},
+		{start: "9.9.0.0", end: "9.9.255.255", region: "日本"},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip          string
+		country     string
+		subdivision string
+		city        string
+		cityShort   string
+		isp         string
+	}{
+		{ip: "1.2.0.0", country: "中国", subdivision: "四川省", city: "成都市", cityShort: "成都", isp: "电信"},
+		{ip: "1.2.3.255", country: "中国", subdivision: "四川省", city: "成都市", cityShort: "成都", isp: "电信"},
+		{ip: "1.2.4.1", country: "中国", subdivision: "新疆维吾尔自治区", city: "乌鲁木齐市", cityShort: "乌鲁木齐", isp: "联通"},
+		{ip: "1.2.200.1", country: "中国"},
+		{ip: "8.8.8.8", country: "美国", isp: "Level3"},
+		// the missing fields of a short region
+		{ip: "9.9.9.9", country: "日本"},
+		// the gap between two segments of a block
+		{ip: "1.2.5.1"},
+		// a block without segments
+		{ip: "1.3.0.1"},
+		{ip: "255.255.255.255"},
+		// xdb only contains IPv4 addresses
+		{ip: "2001:db8::1"},
+		{ip: "::ffff:1.2.0.1", country: "中国", subdivision: "四川省", city: "成都市", cityShort: "成都", isp: "电信"},
+	}
+	for _, test := range tests {
+		info, err := provider.Lookup(net.ParseIP(test.ip))
+		if err != nil {
+			t.Fatalf("%s: %v", test.ip, err)
+		}
+		if country := info.Country.Names["zh-CN"]; country != test.country {
+			t.Errorf("%s: country %q, want %q", test.ip, country, test.country)
+		}
+		var subdivision string
+		if len(info.Subdivisions) > 0 {
+			subdivision = info.Subdivisions[0].Names["zh-CN"]
+		}
+		if subdivision != test.subdivision {
+			t.Errorf("%s: subdivision %q, want %q", test.ip, subdivision, test.subdivision)
+		}
+		if city := info.City.Names["zh-CN"]; city != test.city {
+			t.Errorf("%s: city %q, want %q", test.ip, city, test.city)
+		}
+		if city := info.City.Names["zh"]; city != test.cityShort {
+			t.Errorf("%s: short city %q, want %q", test.ip, city, test.cityShort)
+		}
+		if info.ISP != test.isp {
+			t.Errorf("%s: isp %q, want %q", test.ip, info.ISP, test.isp)
+		}
+	}
+}
+
+func TestIP2RegionLocationInvalid(t *testing.T) {
+	if _, err := NewIP2RegionLocation(filepath.Join(t.TempDir(), "missing.xdb")); err == nil {
+		t.Error("expected error for a missing file")
+	}
+	if _, err := NewIP2RegionLocation(writeXDB(t, make([]byte, xdbHeaderLength+xdbVectorIndexLength-1))); err == nil {
+		t.Error("expected error for a truncated file")
+	}
+
+	content := buildXDB([]xdbSegment{{start: "1.2.0.0", end: "1.2.255.255", region: "中国|0|0|0|0"}})
+	// the data pointer of the only segment beyond the end of the file
+	badData := append([]byte(nil), content...)
+	binary.LittleEndian.PutUint32(badData[len(badData)-4:], uint32(len(badData)))
+	// the segment index of the block beyond the end of the file
+	badIndex := append([]byte(nil), content...)
+	offset := xdbHeaderLength + 1*xdbVectorIndexCols*xdbVectorIndexSize + 2*xdbVectorIndexSize
+	binary.LittleEndian.PutUint32(badIndex[offset:], uint32(len(badIndex)))
+	binary.LittleEndian.PutUint32(badIndex[offset+4:], uint32(len(badIndex)+xdbSegmentIndexSize))
+	for name, content := range map[string][]byte{"data pointer": badData, "segment index": badIndex} {
+		provider, err := NewIP2RegionLocation(writeXDB(t, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := provider.Lookup(net.ParseIP("1.2.3.4")); err == nil {
+			t.Errorf("expected error for an invalid %s", name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package location
+
+import (
+	"encoding/csv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dushxiiang/meteor/pkg/iptrie"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// NewLabelLocation loads user-defined CIDR to label mappings from a csv or yaml file.
+//
+// The csv file has one mapping per line, lines starting with # are ignored:
+//
+//	10.0.0.0/8,office-sh
+//
+// The yaml file is a list of mappings with the cidr and label keys.
+func NewLabelLocation(file string) (Location, error) {
+	var (
+		labels []labelEntry
+		err    error
+	)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		labels, err = readLabelYAML(file)
+	default:
+		labels, err = readLabelCSV(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	trie := iptrie.New[string]()
+	for _, entry := range labels {
+		prefix, err := iptrie.ParsePrefix(entry.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		trie.Insert(prefix, entry.Label)
+	}
+	location := labelLocation{
+		trie: trie,
+	}
+	return &location, nil
+}
+
+type labelEntry struct {
+	CIDR  string `yaml:"cidr"`
+	Label string `yaml:"label"`
+}
+
+type labelLocation struct {
+	trie *iptrie.Trie[string]
+}
+
+// Lookup returns the labels of the longest prefix containing ip.
+func (r labelLocation) Lookup(ip net.IP) (*Info, error) {
+	info := Info{
+		Labels: r.trie.Longest(ip),
+	}
+	return &info, nil
+}
+
+func readLabelCSV(file string) ([]labelEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var labels []labelEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, errors.Errorf("invalid label record %v", record)
+		}
+		labels = append(labels, labelEntry{
+			CIDR:  strings.TrimSpace(record[0]),
+			Label: strings.TrimSpace(record[1]),
+		})
+	}
+	return labels, nil
+}
+
+func readLabelYAML(file string) ([]labelEntry, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var labels []labelEntry
+	if err := yaml.Unmarshal(content, &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+var _ Location = (*labelLocation)(nil)
@@ -1,7 +1,81 @@
 package location
 
-import "net"
+import (
+	"fmt"
+	"net"
+	"strings"
+)
 
 type Location interface {
-	City(ip net.IP) (map[string]string, error)
+	Lookup(ip net.IP) (*Info, error)
+}
+
+// Place is a named geographical area, such as a country or a city.
+type Place struct {
+	Code  string
+	Names map[string]string
+}
+
+type Info struct {
+	City         Place
+	Subdivisions []Place
+	Country      Place
+	Continent    Place
+
+	ASN uint
+	Org string
+	ISP string
+
+	Labels []string
+}
+
+// Reloadable is implemented by the providers backed by files which can be reloaded without restarting.
+type Reloadable interface {
+	Location
+	Reload() error
+	Files() []string
+}
+
+// String returns a short description of the location for logs.
+func (r *Info) String() string {
+	if r == nil {
+		return "unknown"
+	}
+	var parts []string
+	if name := r.City.name(); name != "" {
+		parts = append(parts, name)
+	}
+	for _, subdivision := range r.Subdivisions {
+		if name := subdivision.name(); name != "" {
+			parts = append(parts, name)
+		}
+	}
+	if r.Country.Code != "" {
+		parts = append(parts, r.Country.Code)
+	} else if name := r.Country.name(); name != "" {
+		parts = append(parts, name)
+	}
+	if r.ASN > 0 {
+		parts = append(parts, fmt.Sprintf("AS%d", r.ASN))
+	}
+	if r.ISP != "" {
+		parts = append(parts, r.ISP)
+	}
+	parts = append(parts, r.Labels...)
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r Place) name() string {
+	for _, lang := range []string{"en", "zh-CN"} {
+		if name, ok := r.Names[lang]; ok {
+			return name
+		}
+	}
+	for _, name := range r.Names {
+		return name
+	}
+	return ""
 }
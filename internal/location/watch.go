@@ -0,0 +1,12 @@
+package location
+
+import (
+	"context"
+
+	"github.com/dushxiiang/meteor/pkg/filewatch"
+)
+
+// Watch reloads the provider when any of its files changes.
+func Watch(ctx context.Context, reloadable Reloadable) {
+	filewatch.Watch(ctx, "location", reloadable.Files(), reloadable.Reload)
+}
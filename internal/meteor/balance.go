@@ -0,0 +1,133 @@
+package meteor
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceRandom           = "random"
+	// BalanceSourceHash sends every client ip to the same backend
+	BalanceSourceHash = "source-hash"
+)
+
+// backend is an address of a forwarder's to list.
+type backend struct {
+	addr string
+	// conns is the number of tcp connections or udp sessions forwarded to the backend
+	conns atomic.Int64
+	// healthy is updated by the health check, the backends are healthy until checked
+	healthy atomic.Bool
+}
+
+func newBackend(addr string) *backend {
+	b := backend{addr: addr}
+	b.healthy.Store(true)
+	return &b
+}
+
+func (r *backend) acquire() {
+	r.conns.Add(1)
+}
+
+func (r *backend) release() {
+	r.conns.Add(-1)
+}
+
+type balancer struct {
+	strategy string
+	backends []*backend
+	// backups are only used when all backends are unhealthy
+	backups []*backend
+	next    atomic.Uint64
+}
+
+func newBalancer(strategy string, addrs, backups []string) (*balancer, error) {
+	switch strategy {
+	case "":
+		strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceSourceHash:
+	default:
+		return nil, errors.Errorf("invalid balance %q", strategy)
+	}
+	b := balancer{strategy: strategy}
+	var err error
+	if b.backends, err = newBackends(addrs); err != nil {
+		return nil, err
+	}
+	if len(b.backends) == 0 {
+		return nil, errors.New("no backend")
+	}
+	if b.backups, err = newBackends(backups); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// newBackends trims the addresses and drops the empty ones, an entry may hold several addresses separated by commas.
+func newBackends(addrs []string) ([]*backend, error) {
+	var backends []*backend
+	for _, entry := range addrs {
+		for _, addr := range splitList(entry) {
+			if _, _, err := net.SplitHostPort(preprocessingAddr(addr)); err != nil {
+				return nil, errors.Errorf("invalid backend %q", addr)
+			}
+			backends = append(backends, newBackend(addr))
+		}
+	}
+	return backends, nil
+}
+
+// All returns the backends and the backups.
+func (r *balancer) All() []*backend {
+	return append(append([]*backend(nil), r.backends...), r.backups...)
+}
+
+// Pick chooses a healthy backend for the client ip, falling back to the healthy backups,
+// it returns nil when no backend is healthy.
+func (r *balancer) Pick(ip net.IP) *backend {
+	backends := healthyBackends(r.backends)
+	if len(backends) == 0 {
+		backends = healthyBackends(r.backups)
+	}
+	if len(backends) == 0 {
+		return nil
+	}
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	switch r.strategy {
+	case BalanceLeastConnections:
+		picked := backends[0]
+		for _, backend := range backends[1:] {
+			if backend.conns.Load() < picked.conns.Load() {
+				picked = backend
+			}
+		}
+		return picked
+	case BalanceRandom:
+		return backends[rand.Intn(len(backends))]
+	case BalanceSourceHash:
+		hash := fnv.New32a()
+		_, _ = hash.Write(normalizeIP(ip))
+		return backends[hash.Sum32()%uint32(len(backends))]
+	default:
+		return backends[(r.next.Add(1)-1)%uint64(len(backends))]
+	}
+}
+
+func healthyBackends(backends []*backend) []*backend {
+	healthy := make([]*backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.healthy.Load() {
+			healthy = append(healthy, backend)
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,268 @@
+package meteor
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dushxiiang/meteor/pkg/logger"
+)
+
+// BanConfig bans the clients denied Threshold times within Window for Duration.
+type BanConfig struct {
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+	Duration  time.Duration `yaml:"duration"`
+	// File keeps the bans across restarts, optional
+	File string `yaml:"file"`
+}
+
+const (
+	DefaultBanThreshold = 10
+	DefaultBanWindow    = time.Minute
+	DefaultBanDuration  = time.Hour
+	banSaveInterval     = 10 * time.Second
+)
+
+type Ban struct {
+	IP       string    `json:"ip"`
+	Reason   string    `json:"reason"`
+	Count    int       `json:"count"`
+	BannedAt time.Time `json:"banned_at"`
+	Until    time.Time `json:"until"`
+}
+
+// offender is a client denied recently.
+type offender struct {
+	denials []time.Time
+	reason  string
+}
+
+func NewBanList(config BanConfig) *BanList {
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultBanThreshold
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultBanWindow
+	}
+	if config.Duration <= 0 {
+		config.Duration = DefaultBanDuration
+	}
+	return &BanList{
+		config:    config,
+		bans:      make(map[string]*Ban),
+		offenders: make(map[string]*offender),
+	}
+}
+
+// BanList counts the denials of every client within a sliding window and bans the clients over the threshold.
+type BanList struct {
+	config BanConfig
+
+	mutex     sync.Mutex
+	bans      map[string]*Ban
+	offenders map[string]*offender
+	dirty     bool
+}
+
+// Banned reports whether ip is banned.
+func (r *BanList) Banned(ip net.IP) bool {
+	key := normalizeIP(ip).String()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ban, ok := r.bans[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Until) {
+		delete(r.bans, key)
+		r.dirty = true
+		return false
+	}
+	return true
+}
+
+// Deny records a denial of ip, the ip is banned once it is denied Threshold times within Window.
+func (r *BanList) Deny(ip net.IP, reason string) {
+	key := normalizeIP(ip).String()
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.bans[key]; ok {
+		return
+	}
+	item, ok := r.offenders[key]
+	if !ok {
+		item = &offender{}
+		r.offenders[key] = item
+	}
+	item.denials = append(trimDenials(item.denials, now.Add(-r.config.Window)), now)
+	item.reason = reason
+	if len(item.denials) < r.config.Threshold {
+		return
+	}
+
+	r.bans[key] = &Ban{
+		IP:       key,
+		Reason:   reason,
+		Count:    len(item.denials),
+		BannedAt: now,
+		Until:    now.Add(r.config.Duration),
+	}
+	delete(r.offenders, key)
+	r.dirty = true
+	logger.L.Sugar().Infof("Banned %s for %v, %d denials within %v, last reason: %s", key, r.config.Duration, len(item.denials), r.config.Window, reason)
+}
+
+// Ban returns the active ban of ip.
+func (r *BanList) Ban(ip net.IP) (Ban, bool) {
+	key := normalizeIP(ip).String()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ban, ok := r.bans[key]
+	if !ok || !time.Now().Before(ban.Until) {
+		return Ban{}, false
+	}
+	return *ban, true
+}
+
+// Bans returns the active bans.
+func (r *BanList) Bans() []Ban {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var bans []Ban
+	for _, ban := range r.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	return bans
+}
+
+// Run expires the bans and the denials, and saves the bans to the file periodically until ctx is done.
+func (r *BanList) Run(ctx context.Context) {
+	sugar := logger.L.Sugar()
+	ticker := time.NewTicker(banSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.Save(); err != nil {
+				sugar.Warnf("error saving bans: %v", err)
+			}
+			return
+		case now := <-ticker.C:
+			r.expire(now)
+			if err := r.Save(); err != nil {
+				sugar.Warnf("error saving bans: %v", err)
+			}
+		}
+	}
+}
+
+func (r *BanList) expire(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, ban := range r.bans {
+		if now.After(ban.Until) {
+			delete(r.bans, key)
+			r.dirty = true
+		}
+	}
+	for key, item := range r.offenders {
+		item.denials = trimDenials(item.denials, now.Add(-r.config.Window))
+		if len(item.denials) == 0 {
+			delete(r.offenders, key)
+		}
+	}
+}
+
+// Load reads the bans saved in the file, the expired bans are dropped.
+func (r *BanList) Load() error {
+	if r.config.File == "" {
+		return nil
+	}
+	content, err := os.ReadFile(r.config.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(content, &bans); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range bans {
+		if now.Before(bans[i].Until) {
+			r.bans[bans[i].IP] = &bans[i]
+		}
+	}
+	return nil
+}
+
+// Save writes the bans to the file if they changed since the last save.
+func (r *BanList) Save() error {
+	if r.config.File == "" {
+		return nil
+	}
+	r.mutex.Lock()
+	if !r.dirty {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.dirty = false
+	bans := make([]Ban, 0, len(r.bans))
+	for _, ban := range r.bans {
+		bans = append(bans, *ban)
+	}
+	r.mutex.Unlock()
+
+	if err := writeJSONFile(r.config.File, bans); err != nil {
+		// try again on the next save
+		r.mutex.Lock()
+		r.dirty = true
+		r.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeJSONFile(file string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, content)
+}
+
+// writeFileAtomic writes content to a temporary file and renames it to file, so that file is never half written.
+func writeFileAtomic(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// trimDenials drops the denials before since.
+func trimDenials(denials []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(denials) && denials[i].Before(since) {
+		i++
+	}
+	return denials[i:]
+}
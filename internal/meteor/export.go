@@ -0,0 +1,256 @@
+package meteor
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
+)
+
+// ExportConfig exports the banned and repeatedly denied clients to a file and/or a http endpoint.
+type ExportConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	File     string        `yaml:"file"`
+	// Format of the file is json or netset, json by default
+	Format string `yaml:"format"`
+	// URL receives the json array by POST
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// MinCount is the number of denials required to export a client which is not banned
+	MinCount int `yaml:"min_count"`
+	// Retention is how long a client is kept since it was last seen
+	Retention time.Duration `yaml:"retention"`
+	// MaxEntries is the max number of clients kept, the least recently seen ones are evicted
+	MaxEntries int `yaml:"max_entries"`
+}
+
+const (
+	ExportFormatJSON   = "json"
+	ExportFormatNetset = "netset"
+
+	DefaultExportInterval   = 5 * time.Minute
+	DefaultExportMinCount   = 2
+	DefaultExportRetention  = 24 * time.Hour
+	DefaultExportMaxEntries = 100000
+)
+
+// Offender is a client banned or denied by meteor.
+type Offender struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Count     int       `json:"count"`
+	Banned    bool      `json:"banned"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Location  string    `json:"location,omitempty"`
+}
+
+func NewExporter(config ExportConfig) (*Exporter, error) {
+	if config.File == "" && config.URL == "" {
+		return nil, errors.New("export requires file or url")
+	}
+	switch config.Format {
+	case "":
+		config.Format = ExportFormatJSON
+	case ExportFormatJSON, ExportFormatNetset:
+	default:
+		return nil, errors.Errorf("invalid export format %q", config.Format)
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultExportInterval
+	}
+	if config.MinCount <= 0 {
+		config.MinCount = DefaultExportMinCount
+	}
+	if config.Retention <= 0 {
+		config.Retention = DefaultExportRetention
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultExportMaxEntries
+	}
+	exporter := Exporter{
+		config:    config,
+		offenders: make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+	return &exporter, nil
+}
+
+// Exporter collects the denied clients and exports them periodically.
+type Exporter struct {
+	config ExportConfig
+
+	mutex     sync.Mutex
+	offenders map[string]*list.Element
+	// lru orders the offenders by last seen, the most recent first
+	lru *list.List
+}
+
+// Deny records a denial of ip.
+func (r *Exporter) Deny(ip net.IP, reason string) {
+	key := normalizeIP(ip).String()
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var offender *Offender
+	if element, ok := r.offenders[key]; ok {
+		offender = element.Value.(*Offender)
+		r.lru.MoveToFront(element)
+	} else {
+		if r.lru.Len() >= r.config.MaxEntries {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.offenders, oldest.Value.(*Offender).IP)
+		}
+		offender = &Offender{
+			IP:        key,
+			FirstSeen: now,
+		}
+		r.offenders[key] = r.lru.PushFront(offender)
+	}
+	offender.Reason = reason
+	offender.Count++
+	offender.LastSeen = now
+}
+
+// Run exports the offenders every interval until ctx is done.
+func (r *Exporter) Run(ctx context.Context, bans *BanList, ipLocation location.Location) {
+	sugar := logger.L.Sugar()
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			offenders := r.Offenders(bans, ipLocation)
+			if err := r.Export(offenders); err != nil {
+				sugar.Warnf("error exporting offenders: %v", err)
+				continue
+			}
+			sugar.Debugf("Exported %d offenders", len(offenders))
+		}
+	}
+}
+
+// Offenders returns the banned clients and the clients denied at least MinCount times, sorted by ip.
+func (r *Exporter) Offenders(bans *BanList, ipLocation location.Location) []Offender {
+	now := time.Now()
+	active := make(map[string]Ban)
+	if bans != nil {
+		for _, ban := range bans.Bans() {
+			active[ban.IP] = ban
+		}
+	}
+
+	r.mutex.Lock()
+	var offenders []Offender
+	for key, element := range r.offenders {
+		offender := element.Value.(*Offender)
+		if now.Sub(offender.LastSeen) > r.config.Retention {
+			r.lru.Remove(element)
+			delete(r.offenders, key)
+			continue
+		}
+		_, banned := active[key]
+		offender.Banned = banned
+		if banned || offender.Count >= r.config.MinCount {
+			offenders = append(offenders, *offender)
+		}
+		delete(active, key)
+	}
+	r.mutex.Unlock()
+
+	// the bans loaded from the file have not been seen by this process
+	for _, ban := range active {
+		offenders = append(offenders, Offender{
+			IP:        ban.IP,
+			Reason:    ban.Reason,
+			Count:     ban.Count,
+			Banned:    true,
+			FirstSeen: ban.BannedAt,
+			LastSeen:  ban.BannedAt,
+		})
+	}
+
+	if ipLocation != nil {
+		for i := range offenders {
+			if info, err := ipLocation.Lookup(net.ParseIP(offenders[i].IP)); err == nil {
+				offenders[i].Location = info.String()
+			}
+		}
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		return offenders[i].IP < offenders[j].IP
+	})
+	return offenders
+}
+
+// Export writes the offenders to the file and posts them to the url.
+func (r *Exporter) Export(offenders []Offender) error {
+	if offenders == nil {
+		offenders = []Offender{}
+	}
+	if r.config.File != "" {
+		var err error
+		if r.config.Format == ExportFormatNetset {
+			err = writeNetsetFile(r.config.File, offenders)
+		} else {
+			err = writeJSONFile(r.config.File, offenders)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if r.config.URL != "" {
+		return r.post(offenders)
+	}
+	return nil
+}
+
+func (r *Exporter) post(offenders []Offender) error {
+	body, err := json.Marshal(offenders)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range r.config.Headers {
+		req.Header.Set(key, value)
+	}
+	client := http.Client{
+		Timeout: time.Duration(Timeout) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("failed post %s, status: %s", r.config.URL, resp.Status)
+	}
+	return nil
+}
+
+func writeNetsetFile(file string, offenders []Offender) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# meteor offenders, generated at %s\n", time.Now().Format(time.RFC3339))
+	for _, offender := range offenders {
+		fmt.Fprintf(&buf, "%s # %s, count: %d\n", offender.IP, offender.Reason, offender.Count)
+	}
+	return writeFileAtomic(file, buf.Bytes())
+}
@@ -3,11 +3,13 @@ package meteor
 import (
 	"context"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/pkg/filewatch"
 	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -16,30 +18,161 @@ var (
 )
 
 type Forwarder struct {
-	Protocol string  `yaml:"protocol"`
-	Addr     string  `yaml:"addr"`
-	To       string  `yaml:"to"`
-	Rules    RuleSet `yaml:"rules"`
+	Protocol string `yaml:"protocol"`
+	Addr     string `yaml:"addr"`
+	// To is the list of backends, a single address or separated by commas
+	To []string `yaml:"to"`
+	// Balance is round-robin, least-connections, random or source-hash, round-robin by default
+	Balance string `yaml:"balance"`
+	// Backup is the list of backends used only when all backends of To are unhealthy
+	Backup      []string     `yaml:"backup"`
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	Rules       RuleSet      `yaml:"rules"`
+	// DefaultAction is allow or deny when no rule matches, overrides the global default action
+	DefaultAction string `yaml:"default_action"`
+	// DryRun evaluates the rules, bans and threat intel and logs the denied clients, but never closes the connections
+	DryRun    bool       `yaml:"dry_run"`
+	RateLimit *RateLimit `yaml:"rate_limit"`
+	// ProxyProtocol is v1 or v2, the PROXY protocol header sent to the backends, only v2 supports udp
+	ProxyProtocol string `yaml:"proxy_protocol"`
+	// AcceptProxyProtocol reads the client address from the PROXY protocol header of the trusted sources, tcp only
+	AcceptProxyProtocol *AcceptProxyProtocol `yaml:"accept_proxy_protocol"`
+	// TLS terminates tls before forwarding to the backends, tcp only
+	TLS *TLS `yaml:"tls"`
+
+	limiter  *rateLimiter
+	balancer *balancer
+	checker  *healthChecker
+	// terminator holds the certificates of TLS
+	terminator *tlsTerminator
+}
+
+// Init parses the rules, defaultAction is the global default action.
+func (r *Forwarder) Init(defaultAction string) error {
+	if r.DefaultAction != "" {
+		defaultAction = r.DefaultAction
+	}
+	if err := r.Rules.Init("forwarder "+r.Addr, defaultAction); err != nil {
+		return errors.Wrap(err, "failed parse forwarder rules")
+	}
+	if err := checkProxyProtocol(r.ProxyProtocol, r.Protocol); err != nil {
+		return errors.Wrap(err, "failed parse forwarder proxy protocol")
+	}
+	if r.AcceptProxyProtocol != nil {
+		if r.Protocol != "tcp" {
+			return errors.New("accept_proxy_protocol only supports tcp forwarders")
+		}
+		if err := r.AcceptProxyProtocol.Init(); err != nil {
+			return errors.Wrap(err, "failed parse forwarder accept_proxy_protocol")
+		}
+	}
+	if r.TLS != nil {
+		if r.Protocol != "tcp" {
+			return errors.New("tls only supports tcp forwarders")
+		}
+		terminator, err := newTLSTerminator(*r.TLS)
+		if err != nil {
+			return errors.Wrap(err, "failed parse forwarder tls")
+		}
+		r.terminator = terminator
+	}
+	balancer, err := newBalancer(r.Balance, r.To, r.Backup)
+	if err != nil {
+		return errors.Wrap(err, "failed parse forwarder backends")
+	}
+	r.balancer = balancer
+	if r.HealthCheck != nil {
+		checker, err := newHealthChecker(*r.HealthCheck, r.Protocol)
+		if err != nil {
+			return errors.Wrap(err, "failed parse forwarder health check")
+		}
+		r.checker = checker
+	}
+	if r.RateLimit != nil {
+		limiter, err := newRateLimiter(*r.RateLimit)
+		if err != nil {
+			return errors.Wrap(err, "failed parse forwarder rate limit")
+		}
+		r.limiter = limiter
+	}
+	return nil
 }
 
-func (r *Forwarder) Forward(ctx context.Context, ipLocation location.Location) {
+func (r *Forwarder) Forward(ctx context.Context, guard *Guard) {
+	r.Rules.Refresh(ctx)
+	if r.limiter != nil {
+		go r.limiter.Cleanup(ctx)
+	}
+	if r.checker != nil {
+		r.checker.Run(ctx, "forwarder "+r.Addr, r.balancer.All())
+	}
+	if r.terminator != nil {
+		go filewatch.Watch(ctx, "forwarder "+r.Addr+" tls", r.terminator.Files(), r.terminator.Reload)
+	}
 	switch r.Protocol {
 	case "tcp":
-		r.forwardTCP(ctx, ipLocation)
+		r.forwardTCP(ctx, guard)
 	case "udp":
-		r.forwardUDP(ctx, ipLocation)
+		r.forwardUDP(ctx, guard)
 	}
 }
 
-func (r *Forwarder) forwardTCP(ctx context.Context, ipLocation location.Location) {
+// allowed checks the bans, the threat intel and the rules of ip, logDryRun logs the clients
+// that a dry run would deny, the udp forwarder only logs them once per client session.
+func (r *Forwarder) allowed(ip net.IP, guard *Guard, logDryRun bool) bool {
+	if reason, blocked := guard.Blocked(ip); blocked {
+		if r.DryRun {
+			if logDryRun {
+				logger.L.Sugar().Infof("Dry run, forwarder %s would deny %v, %s", r.Addr, ip, reason)
+			}
+			return true
+		}
+		logger.L.Sugar().Debugf("Forwarder %s denied %v, %s", r.Addr, ip, reason)
+		return false
+	}
+	if r.Rules.Allowed(ip, guard.Location) {
+		return true
+	}
+	if r.DryRun {
+		if logDryRun {
+			logger.L.Sugar().Infof("Dry run, forwarder %s would deny %v", r.Addr, ip)
+		}
+		return true
+	}
+	guard.Deny(ip, "denied by forwarder "+r.Addr)
+	return false
+}
+
+// acquire takes a rate limit slot of ip, the over limit clients are recorded as denied.
+func (r *Forwarder) acquire(ip net.IP, guard *Guard) bool {
+	if r.limiter == nil || r.limiter.Acquire(ip) {
+		return true
+	}
+	guard.Deny(ip, "rate limited by forwarder "+r.Addr)
+	return false
+}
+
+func (r *Forwarder) release(ip net.IP) {
+	if r.limiter != nil {
+		r.limiter.Release(ip)
+	}
+}
+
+func (r *Forwarder) forwardTCP(ctx context.Context, guard *Guard) {
 	sugar := logger.L.Sugar()
 	ln, err := net.Listen("tcp", preprocessingAddr(r.Addr))
 	if err != nil {
 		sugar.Error("error listening address", err)
 		return
 	}
+	if r.AcceptProxyProtocol != nil {
+		ln = r.AcceptProxyProtocol.Listener(ln)
+	}
+	if r.terminator != nil {
+		ln = r.terminator.Listener(ln)
+	}
 	defer ln.Close()
-	sugar.Infof("TCP forwarder started: %s -> %s", ln.Addr().String(), r.To)
+	sugar.Infof("TCP forwarder started: %s -> %s", ln.Addr().String(), strings.Join(r.To, ","))
 	for {
 		select {
 		case <-ctx.Done():
@@ -53,21 +186,50 @@ func (r *Forwarder) forwardTCP(ctx context.Context, ipLocation location.Location
 			continue
 		}
 		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-		if ok {
-			if !r.Rules.Allowed(tcpAddr.IP, ipLocation) {
-				_ = conn.Close()
-				continue
-			}
+		if !ok {
+			_ = conn.Close()
+			continue
+		}
+		if !r.allowed(tcpAddr.IP, guard, true) {
+			_ = conn.Close()
+			continue
+		}
+		if !r.acquire(tcpAddr.IP, guard) {
+			sugar.Debugf("TCP client rate limited, %s <- %s", conn.LocalAddr(), conn.RemoteAddr())
+			_ = conn.Close()
+			continue
 		}
 
 		sugar.Debugf("TCP client connected, %s <- %s", conn.LocalAddr(), conn.RemoteAddr())
 		go func() {
 			defer conn.Close()
-			backend, err := net.DialTimeout("tcp", r.To, time.Duration(Timeout)*time.Second)
+			defer r.release(tcpAddr.IP)
+			if r.terminator != nil {
+				if err := r.terminator.Handshake(conn); err != nil {
+					sugar.Debugf("TLS handshake err: %v, %s <- %s", err, conn.LocalAddr(), conn.RemoteAddr())
+					return
+				}
+			}
+			picked := r.balancer.Pick(tcpAddr.IP)
+			if picked == nil {
+				sugar.Warnf("Forwarder %s has no healthy backend, %s <- %s", r.Addr, conn.LocalAddr(), conn.RemoteAddr())
+				return
+			}
+			picked.acquire()
+			defer picked.release()
+			backend, err := net.DialTimeout("tcp", picked.addr, time.Duration(Timeout)*time.Second)
 			if err != nil {
-				sugar.Errorf("forward to %s err: %v", r.To, err)
+				sugar.Errorf("forward to %s err: %v", picked.addr, err)
 				return
 			}
+			defer backend.Close()
+			if r.ProxyProtocol != "" {
+				header := proxyProtocolHeader(r.ProxyProtocol, "tcp", conn.RemoteAddr(), conn.LocalAddr())
+				if _, err := backend.Write(header); err != nil {
+					sugar.Errorf("forward to %s err: %v", picked.addr, err)
+					return
+				}
+			}
 			sugar.Debugf("Meteor TCP client connected, %s -> %s", backend.LocalAddr(), backend.RemoteAddr())
 			sugar.Debugf("Start mutual copy...")
 			mutualCopyIO(backend, conn)
@@ -111,18 +273,13 @@ func (r *UDPForwarder) Set(key string, conn *UDPConnWrap) {
 	r.udpConnMap[key] = conn
 }
 
-func (r *Forwarder) forwardUDP(ctx context.Context, ipLocation location.Location) {
+func (r *Forwarder) forwardUDP(ctx context.Context, guard *Guard) {
 	sugar := logger.L.Sugar()
 	src, err := net.ResolveUDPAddr("udp", preprocessingAddr(r.Addr))
 	if err != nil {
 		sugar.Error("error resolving local address", err)
 		return
 	}
-	dst, err := net.ResolveUDPAddr("udp", preprocessingAddr(r.To))
-	if err != nil {
-		sugar.Error("error resolving remote address", err)
-		return
-	}
 
 	localConn, err := net.ListenUDP("udp", src)
 	if err != nil {
@@ -131,7 +288,7 @@ func (r *Forwarder) forwardUDP(ctx context.Context, ipLocation location.Location
 	}
 	defer localConn.Close()
 
-	sugar.Infof("UDP forwarder started: %s -> %s", src, dst)
+	sugar.Infof("UDP forwarder started: %s -> %s", src, strings.Join(r.To, ","))
 
 	udpForwarder := NewUDPForwarder()
 	buffer := make([]byte, UDPPacketSize)
@@ -148,28 +305,51 @@ func (r *Forwarder) forwardUDP(ctx context.Context, ipLocation location.Location
 			return
 		}
 
-		if !r.Rules.Allowed(clientAddr.IP, ipLocation) {
+		udpConnWrap, ok := udpForwarder.Get(clientAddr.String())
+		if !r.allowed(clientAddr.IP, guard, !ok) {
 			continue
 		}
-
-		udpConnWrap, ok := udpForwarder.Get(clientAddr.String())
 		if !ok {
+			if !r.acquire(clientAddr.IP, guard) {
+				sugar.Debugf("UDP client rate limited, %s <- %s", localConn.LocalAddr(), clientAddr)
+				continue
+			}
 			sugar.Debugf("UDP client connected, %s <- %s", localConn.LocalAddr(), clientAddr)
+			// 为客户端会话选择后端
+			picked := r.balancer.Pick(clientAddr.IP)
+			if picked == nil {
+				sugar.Warnf("Forwarder %s has no healthy backend, %s <- %s", r.Addr, localConn.LocalAddr(), clientAddr)
+				r.release(clientAddr.IP)
+				continue
+			}
+			dst, err := net.ResolveUDPAddr("udp", preprocessingAddr(picked.addr))
+			if err != nil {
+				sugar.Warn("Error resolving remote address:", err)
+				r.release(clientAddr.IP)
+				continue
+			}
 			// 创建远程UDP连接
 			remoteConn, err := net.DialUDP("udp", nil, dst)
 			if err != nil {
 				sugar.Warn("Error connecting to remote address:", err)
+				r.release(clientAddr.IP)
 				continue
 			}
+			picked.acquire()
 			sugar.Debugf("Meteor UDP client connected, %s -> %s", remoteConn.LocalAddr(), remoteConn.RemoteAddr())
 			udpConnWrap = &UDPConnWrap{
 				clientAddr: clientAddr,
 				localConn:  localConn,
 				remoteConn: remoteConn,
 			}
+			if r.ProxyProtocol != "" {
+				udpConnWrap.header = proxyProtocolHeader(r.ProxyProtocol, "udp", clientAddr, localConn.LocalAddr())
+			}
 			udpForwarder.Set(clientAddr.String(), udpConnWrap)
 
 			go func() {
+				defer r.release(clientAddr.IP)
+				defer picked.release()
 				defer udpForwarder.Del(clientAddr.String())
 				udpConnWrap.Loop()
 			}()
@@ -188,6 +368,8 @@ type UDPConnWrap struct {
 	clientAddr *net.UDPAddr
 	localConn  *net.UDPConn
 	remoteConn *net.UDPConn
+	// header is the PROXY protocol header prepended to every datagram sent to the backend
+	header []byte
 }
 
 func (r *UDPConnWrap) Read(b []byte) (n int, err error) {
@@ -197,6 +379,10 @@ func (r *UDPConnWrap) Read(b []byte) (n int, err error) {
 
 func (r *UDPConnWrap) Write(data []byte) (int, error) {
 	_ = r.remoteConn.SetDeadline(time.Now().Add(UDPTimeout))
+	if len(r.header) > 0 {
+		n, err := r.remoteConn.Write(append(r.header[:len(r.header):len(r.header)], data...))
+		return max(n-len(r.header), 0), err
+	}
 	return r.remoteConn.Write(data)
 }
 
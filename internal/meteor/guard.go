@@ -0,0 +1,81 @@
+package meteor
+
+import (
+	"net"
+
+	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/pkg/logger"
+)
+
+// Guard holds the location service and the global checks shared by every forwarder and proxy.
+type Guard struct {
+	Location location.Location
+	Bans     *BanList
+	Intel    *ThreatIntel
+	Exporter *Exporter
+}
+
+// Blocked reports whether ip is banned or listed by a threat intelligence feed, and why.
+func (r *Guard) Blocked(ip net.IP) (string, bool) {
+	if r.Bans != nil && r.Bans.Banned(ip) {
+		return "banned", true
+	}
+	if r.Intel != nil {
+		if feed, ok := r.Intel.Listed(ip); ok {
+			return "listed by threat intel feed " + feed, true
+		}
+	}
+	return "", false
+}
+
+// Deny records a denial of ip for the ban list and the exporter.
+func (r *Guard) Deny(ip net.IP, reason string) {
+	if r.Bans != nil {
+		r.Bans.Deny(ip, reason)
+	}
+	if r.Exporter != nil {
+		r.Exporter.Deny(ip, reason)
+	}
+}
+
+// Listener wraps ln, the connections of the blocked clients and of the clients denied
+// by rules are closed once accepted.
+func (r *Guard) Listener(ln net.Listener, name string, rules RuleSet) net.Listener {
+	return &guardListener{
+		Listener: ln,
+		guard:    r,
+		name:     name,
+		rules:    rules,
+	}
+}
+
+type guardListener struct {
+	net.Listener
+	guard *Guard
+	name  string
+	rules RuleSet
+}
+
+func (r *guardListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := r.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return conn, nil
+		}
+		if reason, blocked := r.guard.Blocked(tcpAddr.IP); blocked {
+			logger.L.Sugar().Debugf("%s denied %v, %s", r.name, tcpAddr.IP, reason)
+			_ = conn.Close()
+			continue
+		}
+		if !r.rules.Allowed(tcpAddr.IP, r.guard.Location) {
+			r.guard.Deny(tcpAddr.IP, "denied by "+r.name)
+			_ = conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
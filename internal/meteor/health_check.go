@@ -0,0 +1,180 @@
+package meteor
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
+)
+
+// HealthCheck checks every backend of a forwarder periodically, the unhealthy backends are
+// taken out of rotation until they pass the check again.
+type HealthCheck struct {
+	// Type is tcp, http or udp, tcp by default, udp forwarders only support udp
+	Type     string        `yaml:"type"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Rise is the number of consecutive successes to mark a backend healthy
+	Rise int `yaml:"rise"`
+	// Fall is the number of consecutive failures to mark a backend unhealthy
+	Fall int `yaml:"fall"`
+	// Path is the url path requested by the http check, / by default
+	Path string `yaml:"path"`
+	// Send is the payload of the udp probe, required by the udp check,
+	// any response passes the check unless Expect is set
+	Send   string `yaml:"send"`
+	Expect string `yaml:"expect"`
+}
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckUDP  = "udp"
+
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+// newHealthChecker fills the defaults of config, protocol is the protocol of the forwarder.
+func newHealthChecker(config HealthCheck, protocol string) (*healthChecker, error) {
+	if config.Type == "" {
+		config.Type = HealthCheckTCP
+		if protocol == "udp" {
+			config.Type = HealthCheckUDP
+		}
+	}
+	// the udp backends never accept tcp connections
+	if protocol == "udp" && config.Type != HealthCheckUDP {
+		return nil, errors.Errorf("udp forwarder does not support %s health check", config.Type)
+	}
+	switch config.Type {
+	case HealthCheckTCP, HealthCheckHTTP:
+	case HealthCheckUDP:
+		// most udp services never reply to an empty datagram
+		if config.Send == "" {
+			return nil, errors.New("udp health check requires send")
+		}
+	default:
+		return nil, errors.Errorf("invalid health check type %q", config.Type)
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultHealthCheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultHealthCheckTimeout
+	}
+	if config.Rise <= 0 {
+		config.Rise = DefaultHealthCheckRise
+	}
+	if config.Fall <= 0 {
+		config.Fall = DefaultHealthCheckFall
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	checker := healthChecker{
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	return &checker, nil
+}
+
+type healthChecker struct {
+	config HealthCheck
+	client *http.Client
+}
+
+// Run checks the backends until ctx is done, name identifies the forwarder in logs.
+func (r *healthChecker) Run(ctx context.Context, name string, backends []*backend) {
+	for _, backend := range backends {
+		go r.watch(ctx, name, backend)
+	}
+}
+
+func (r *healthChecker) watch(ctx context.Context, name string, backend *backend) {
+	sugar := logger.L.Sugar()
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	var successes, failures int
+	for {
+		err := r.check(backend.addr)
+		if err == nil {
+			successes, failures = successes+1, 0
+			if !backend.healthy.Load() && successes >= r.config.Rise {
+				backend.healthy.Store(true)
+				sugar.Infof("Backend %s of %s is healthy", backend.addr, name)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if backend.healthy.Load() && failures >= r.config.Fall {
+				backend.healthy.Store(false)
+				sugar.Warnf("Backend %s of %s is unhealthy: %v", backend.addr, name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *healthChecker) check(addr string) error {
+	switch r.config.Type {
+	case HealthCheckHTTP:
+		return r.checkHTTP(addr)
+	case HealthCheckUDP:
+		return r.checkUDP(addr)
+	default:
+		conn, err := net.DialTimeout("tcp", addr, r.config.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// checkHTTP requests the path of the backend, the 2xx and 3xx responses pass the check.
+func (r *healthChecker) checkHTTP(addr string) error {
+	resp, err := r.client.Get("http://" + addr + r.config.Path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *healthChecker) checkUDP(addr string) error {
+	conn, err := net.DialTimeout("udp", preprocessingAddr(addr), r.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	if _, err := conn.Write([]byte(r.config.Send)); err != nil {
+		return err
+	}
+	buffer := make([]byte, UDPPacketSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return err
+	}
+	if r.config.Expect != "" && !bytes.Contains(buffer[:n], []byte(r.config.Expect)) {
+		return errors.New("unexpected response")
+	}
+	return nil
+}
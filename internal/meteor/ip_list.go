@@ -0,0 +1,64 @@
+package meteor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dushxiiang/meteor/pkg/iptrie"
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
+)
+
+func readIPFile(file string) ([]*net.IPNet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	prefixes, err := iptrie.ReadPrefixes(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed parse %s", file)
+	}
+	return prefixes, nil
+}
+
+func fetchIPURL(url string) ([]*net.IPNet, error) {
+	client := http.Client{
+		Timeout: time.Duration(Timeout) * time.Second,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed fetch %s, status: %s", url, resp.Status)
+	}
+	prefixes, err := iptrie.ReadPrefixes(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed parse %s", url)
+	}
+	return prefixes, nil
+}
+
+// refreshEvery calls refresh every interval until ctx is done.
+func refreshEvery(ctx context.Context, interval time.Duration, name string, refresh func() error) {
+	sugar := logger.L.Sugar()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := refresh(); err != nil {
+				sugar.Warnf("error refreshing %s: %v", name, err)
+				continue
+			}
+			sugar.Debugf("Refreshed %s", name)
+		}
+	}
+}
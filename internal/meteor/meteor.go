@@ -2,13 +2,17 @@ package meteor
 
 import (
 	"context"
+	"fmt"
 	"github.com/dushxiiang/meteor/internal/location"
 	"github.com/dushxiiang/meteor/pkg/logger"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/kardianos/service"
 	"github.com/mitchellh/mapstructure"
@@ -17,17 +21,37 @@ import (
 )
 
 const Timeout int = 10
+const (
+	DefaultLocationCacheSize = 10240
+	DefaultLocationCacheTTL  = 10 * time.Minute
+)
 const Version = "v0.1.0"
 
 type Config struct {
-	Forwarders []Forwarder    `yaml:"forwarders"`
-	Proxies    []Proxy        `yaml:"proxies"`
-	Location   LocationConfig `yaml:"location"`
+	Forwarders []Forwarder `yaml:"forwarders"`
+	Proxies    []Proxy     `yaml:"proxies"`
+	// Location accepts a single provider or an ordered list of providers
+	Location      []LocationConfig    `yaml:"location"`
+	LocationCache LocationCacheConfig `yaml:"location_cache"`
+	// DefaultAction is allow or deny when no rule of a forwarder matches, allow by default,
+	// it does not apply to proxies
+	DefaultAction string `yaml:"default_action"`
+	// Ban bans the clients denied repeatedly, disabled when not configured
+	Ban         *BanConfig         `yaml:"ban"`
+	ThreatIntel *ThreatIntelConfig `yaml:"threat_intel"`
 }
 
 type LocationConfig struct {
-	Type string `yaml:"type"`
-	File string `yaml:"file"`
+	Type    string `yaml:"type"`
+	File    string `yaml:"file"`
+	ASNFile string `yaml:"asn_file"`
+}
+
+type LocationCacheConfig struct {
+	// Size is the max number of cached results, a negative size disables the cache
+	Size          int           `yaml:"size"`
+	TTL           time.Duration `yaml:"ttl"`
+	StatsInterval time.Duration `yaml:"stats_interval"`
 }
 
 func readConfig(config string) (cfg *Config, err error) {
@@ -38,6 +62,11 @@ func readConfig(config string) (cfg *Config, err error) {
 	} else {
 		err := viper.Unmarshal(&cfg, func(decoderConfig *mapstructure.DecoderConfig) {
 			decoderConfig.TagName = "yaml"
+			decoderConfig.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+				ruleSetDecodeHook,
+				mapstructure.StringToTimeDurationHookFunc(),
+				mapstructure.StringToSliceHookFunc(","),
+			)
 		})
 		if err != nil {
 			logger.L.Sugar().Errorf("unmarshal config err: %s", err.Error())
@@ -45,10 +74,13 @@ func readConfig(config string) (cfg *Config, err error) {
 		}
 	}
 	for i := range cfg.Forwarders {
-		for j := range cfg.Forwarders[i].Rules {
-			if err := cfg.Forwarders[i].Rules[j].Init(); err != nil {
-				return nil, errors.Wrap(err, "failed parse forwarder rules")
-			}
+		if err := cfg.Forwarders[i].Init(cfg.DefaultAction); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Proxies {
+		if err := cfg.Proxies[i].Init(); err != nil {
+			return nil, err
 		}
 	}
 	return cfg, nil
@@ -66,6 +98,26 @@ func New(config string) (*Meteor, error) {
 		cfg:    cfg,
 		quit:   make(chan struct{}),
 	}
+	if cfg.Ban != nil {
+		meteor.bans = NewBanList(*cfg.Ban)
+		if err := meteor.bans.Load(); err != nil {
+			return nil, errors.Wrap(err, "failed load bans")
+		}
+	}
+	if cfg.ThreatIntel != nil {
+		intel, err := NewThreatIntel(*cfg.ThreatIntel)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed parse threat intel")
+		}
+		meteor.Intel = intel
+		if cfg.ThreatIntel.Export != nil {
+			exporter, err := NewExporter(*cfg.ThreatIntel.Export)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed parse threat intel export")
+			}
+			meteor.exporter = exporter
+		}
+	}
 	return &meteor, nil
 }
 
@@ -74,8 +126,21 @@ type Meteor struct {
 	cancel context.CancelFunc
 	cfg    *Config
 
-	Location location.Location
-	quit     chan struct{}
+	Location      location.Location
+	locationCache *location.CacheLocation
+	bans          *BanList
+	Intel         *ThreatIntel
+	exporter      *Exporter
+	quit          chan struct{}
+}
+
+func (r *Meteor) Forwarders() []Forwarder {
+	return r.cfg.Forwarders
+}
+
+// Bans returns the ban list, nil when ban is not configured.
+func (r *Meteor) Bans() *BanList {
+	return r.bans
 }
 
 func (r *Meteor) Start(s service.Service) error {
@@ -84,44 +149,157 @@ func (r *Meteor) Start(s service.Service) error {
 }
 
 func (r *Meteor) Run() {
+	guard := &Guard{
+		Location: r.Location,
+		Bans:     r.bans,
+		Intel:    r.Intel,
+		Exporter: r.exporter,
+	}
+	if r.bans != nil {
+		go r.bans.Run(r.ctx)
+	}
+	if r.Intel != nil {
+		r.Intel.Run(r.ctx)
+	}
+	if r.exporter != nil {
+		go r.exporter.Run(r.ctx, r.bans, r.Location)
+	}
+
 	forwarders := r.cfg.Forwarders
 	for i := range forwarders {
-		go forwarders[i].Forward(r.ctx, r.Location)
+		go forwarders[i].Forward(r.ctx, guard)
 	}
 
 	proxies := r.cfg.Proxies
 	for i := range proxies {
-		go proxies[i].Run(r.ctx)
+		go proxies[i].Run(r.ctx, guard)
+	}
+
+	if r.locationCache != nil && r.cfg.LocationCache.StatsInterval > 0 {
+		go r.logLocationCacheStats(r.cfg.LocationCache.StatsInterval)
+	}
+
+	if reloadable, ok := r.Location.(location.Reloadable); ok {
+		go location.Watch(r.ctx, reloadable)
 	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
-	select {
-	case <-interrupt:
-		close(r.quit)
-	case <-r.quit:
-		r.cancel()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for {
+		select {
+		case <-hangup:
+			r.Reload()
+		case <-interrupt:
+			close(r.quit)
+			r.shutdown()
+			return
+		case <-r.quit:
+			r.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown stops the forwarders and the proxies, and saves the bans.
+func (r *Meteor) shutdown() {
+	r.cancel()
+	if r.bans != nil {
+		if err := r.bans.Save(); err != nil {
+			logger.L.Sugar().Warnf("error saving bans: %v", err)
+		}
+	}
+}
+
+// Reload reloads the files of the location service and the tls certificates of the forwarders.
+func (r *Meteor) Reload() {
+	sugar := logger.L.Sugar()
+	if reloadable, ok := r.Location.(location.Reloadable); ok {
+		if err := reloadable.Reload(); err != nil {
+			sugar.Warnf("error reloading location files: %v", err)
+		} else {
+			sugar.Infof("Reloaded location files")
+		}
+	}
+	for _, forwarder := range r.cfg.Forwarders {
+		if forwarder.terminator == nil {
+			continue
+		}
+		if err := forwarder.terminator.Reload(); err != nil {
+			sugar.Warnf("error reloading forwarder %s tls files: %v", forwarder.Addr, err)
+		} else {
+			sugar.Infof("Reloaded forwarder %s tls files", forwarder.Addr)
+		}
 	}
 }
 
 func (r *Meteor) Stop(s service.Service) error {
 	close(r.quit)
+	r.shutdown()
 	return nil
 }
 
 func (r *Meteor) InitLocationService() error {
-	locationConfig := r.cfg.Location
-	switch locationConfig.Type {
-	case "geoip":
-		ipLocation, err := location.NewGeoIPLocation(locationConfig.File)
+	var (
+		providers []location.Location
+		messages  []string
+	)
+	for _, locationConfig := range r.cfg.Location {
+		provider, err := newLocation(locationConfig)
 		if err != nil {
-			return err
+			messages = append(messages, fmt.Sprintf("location %s: %s", locationConfig.Type, err.Error()))
+			continue
 		}
-		r.Location = ipLocation
+		providers = append(providers, provider)
+	}
+	if len(providers) > 0 {
+		r.Location = location.NewChainLocation(providers...)
+		if cacheConfig := r.cfg.LocationCache; cacheConfig.Size >= 0 {
+			size, ttl := cacheConfig.Size, cacheConfig.TTL
+			if size == 0 {
+				size = DefaultLocationCacheSize
+			}
+			if ttl == 0 {
+				ttl = DefaultLocationCacheTTL
+			}
+			r.locationCache = location.NewCacheLocation(r.Location, size, ttl)
+			r.Location = r.locationCache
+		}
+	}
+	if len(messages) > 0 {
+		return errors.Errorf("failed to init location service, %s", strings.Join(messages, "; "))
 	}
 	return nil
 }
 
+func (r *Meteor) logLocationCacheStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			stats := r.locationCache.Stats()
+			logger.L.Sugar().Infof("Location cache stats, size: %d, hits: %d, misses: %d", stats.Size, stats.Hits, stats.Misses)
+		}
+	}
+}
+
+func newLocation(locationConfig LocationConfig) (location.Location, error) {
+	switch locationConfig.Type {
+	case "geoip":
+		return location.NewGeoIPLocation(locationConfig.File, locationConfig.ASNFile)
+	case "ip2region":
+		return location.NewIP2RegionLocation(locationConfig.File)
+	case "label":
+		return location.NewLabelLocation(locationConfig.File)
+	default:
+		return nil, errors.Errorf("unknown location type %q", locationConfig.Type)
+	}
+}
+
 type ConnCopier struct {
 	User, Backend io.ReadWriter
 }
@@ -147,9 +325,18 @@ func mutualCopyIO(conn0, conn1 net.Conn) {
 	<-errc
 }
 
+// preprocessingAddr turns a bare port into a dual-stack listen address, other addresses are returned as is.
 func preprocessingAddr(addr string) string {
-	if !strings.Contains(addr, ":") {
-		addr = "0.0.0.0:" + addr
+	if _, err := strconv.Atoi(addr); err == nil {
+		return ":" + addr
 	}
 	return addr
 }
+
+// normalizeIP converts IPv4-mapped IPv6 addresses to IPv4 addresses.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/dushxiiang/meteor/pkg/logger"
 
 	"github.com/armon/go-socks5"
+	pkgerrors "github.com/pkg/errors"
 )
 
 type Proxy struct {
@@ -24,6 +25,12 @@ type Proxy struct {
 	Key      string    `yaml:"key"`
 	Auth     bool      `yaml:"auth"`
 	Accounts []Account `yaml:"accounts"`
+	// Rules are evaluated on the client address before auth
+	Rules RuleSet `yaml:"rules"`
+	// DefaultAction is allow or deny when no rule matches, allow by default
+	DefaultAction string `yaml:"default_action"`
+	// AcceptProxyProtocol reads the client address from the PROXY protocol header of the trusted sources
+	AcceptProxyProtocol *AcceptProxyProtocol `yaml:"accept_proxy_protocol"`
 }
 
 type Account struct {
@@ -31,18 +38,48 @@ type Account struct {
 	Password string
 }
 
-func (p Proxy) Run(ctx context.Context) {
+func (p *Proxy) Init() error {
+	if err := p.Rules.Init(p.name(), p.DefaultAction); err != nil {
+		return pkgerrors.Wrap(err, "failed parse proxy rules")
+	}
+	if p.AcceptProxyProtocol != nil {
+		if err := p.AcceptProxyProtocol.Init(); err != nil {
+			return pkgerrors.Wrap(err, "failed parse proxy accept_proxy_protocol")
+		}
+	}
+	return nil
+}
+
+func (p Proxy) name() string {
+	return p.Protocol + " proxy " + p.Addr
+}
+
+func (p Proxy) Run(ctx context.Context, guard *Guard) {
+	p.Rules.Refresh(ctx)
 	switch p.Protocol {
 	case "http":
-		p.startHttpProxyServer(ctx)
+		p.startHttpProxyServer(ctx, guard)
 	case "https":
-		p.startHttpsProxyServer(ctx)
+		p.startHttpsProxyServer(ctx, guard)
 	case "socks5":
-		p.startSocks5ProxyServer(ctx)
+		p.startSocks5ProxyServer(ctx, guard)
+	}
+}
+
+// listen listens on the address of the proxy, the connections of the blocked clients
+// and of the clients denied by rules are closed once accepted.
+func (p Proxy) listen(guard *Guard) (net.Listener, error) {
+	ln, err := net.Listen("tcp", preprocessingAddr(p.Addr))
+	if err != nil {
+		return nil, err
 	}
+	if p.AcceptProxyProtocol != nil {
+		ln = p.AcceptProxyProtocol.Listener(ln)
+	}
+	return guard.Listener(ln, p.name(), p.Rules), nil
 }
 
-func (p Proxy) startHttpProxyServer(ctx context.Context) {
+func (p Proxy) startHttpProxyServer(ctx context.Context, guard *Guard) {
 	sugar := logger.L.Sugar()
 	server := &http.Server{
 		Addr: p.Addr,
@@ -62,10 +99,16 @@ func (p Proxy) startHttpProxyServer(ctx context.Context) {
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
+	ln, err := p.listen(guard)
+	if err != nil {
+		sugar.Error("error listening on address", err)
+		return
+	}
+
 	sugar.Infof("HTTP proxy server started: %s, with auth enabled: %v", p.Addr, p.Auth)
 
 	go func() {
-		err := server.ListenAndServe()
+		err := server.Serve(ln)
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			sugar.Error("shutting down the proxy server", err)
 		}
@@ -113,7 +156,7 @@ func (p Proxy) auth(r *http.Request) bool {
 	return passed
 }
 
-func (p Proxy) startHttpsProxyServer(ctx context.Context) {
+func (p Proxy) startHttpsProxyServer(ctx context.Context, guard *Guard) {
 	sugar := logger.L.Sugar()
 	server := &http.Server{
 		Addr: p.Addr,
@@ -131,10 +174,16 @@ func (p Proxy) startHttpsProxyServer(ctx context.Context) {
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
+	ln, err := p.listen(guard)
+	if err != nil {
+		sugar.Error("error listening on address", err)
+		return
+	}
+
 	sugar.Infof("HTTPS proxy server started: %s, with auth enabled: %v", p.Addr, p.Auth)
 
 	go func() {
-		err := server.ListenAndServeTLS(p.Cert, p.Key)
+		err := server.ServeTLS(ln, p.Cert, p.Key)
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			sugar.Error("shutting down the proxy server", err)
 		}
@@ -160,7 +209,7 @@ func (p Proxy) Valid(username, password string) bool {
 	return passed
 }
 
-func (p Proxy) startSocks5ProxyServer(ctx context.Context) {
+func (p Proxy) startSocks5ProxyServer(ctx context.Context, guard *Guard) {
 	sugar := logger.L.Sugar()
 
 	conf := &socks5.Config{
@@ -171,14 +220,13 @@ func (p Proxy) startSocks5ProxyServer(ctx context.Context) {
 	server, _ := socks5.New(conf)
 
 	// 指定监听地址和端口
-	addr := preprocessingAddr(p.Addr)
-	ln, err := net.Listen("tcp", addr)
+	ln, err := p.listen(guard)
 	if err != nil {
 		sugar.Error("error listening on address", err)
 		return
 	}
 
-	sugar.Infof("Socks5 proxy server started: %s, with auth enabled: %v", addr, p.Auth)
+	sugar.Infof("Socks5 proxy server started: %s, with auth enabled: %v", ln.Addr(), p.Auth)
 	go func() {
 		if err := server.Serve(ln); err != nil {
 			sugar.Warnf("Socks5 proxy server stoped: %s", err.Error())
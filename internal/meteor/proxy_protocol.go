@@ -0,0 +1,339 @@
+package meteor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	DefaultAcceptProxyProtocolTimeout = 5 * time.Second
+	// proxyProtocolV1MaxLength is the max length of a v1 header including the CRLF
+	proxyProtocolV1MaxLength = 107
+)
+
+// AcceptProxyProtocol parses the PROXY protocol v1 or v2 header sent by the trusted load balancers,
+// the client address of the header is used by rules, logs and rate limits.
+type AcceptProxyProtocol struct {
+	// Trusted is the list of sources allowed to send the header, separated by commas,
+	// the connections from other sources are handled as plain clients
+	Trusted string `yaml:"trusted"`
+	// Timeout is the max time to wait for the header, 5s by default
+	Timeout time.Duration `yaml:"timeout"`
+
+	trusted []*net.IPNet
+}
+
+func (r *AcceptProxyProtocol) Init() error {
+	trusted, err := parsePrefixes(r.Trusted)
+	if err != nil {
+		return err
+	}
+	if len(trusted) == 0 {
+		return errors.New("no trusted source")
+	}
+	r.trusted = trusted
+	if r.Timeout <= 0 {
+		r.Timeout = DefaultAcceptProxyProtocolTimeout
+	}
+	return nil
+}
+
+// Listener wraps ln, the headers are read in the background so that a slow client never blocks Accept.
+func (r *AcceptProxyProtocol) Listener(ln net.Listener) net.Listener {
+	l := &proxyProtocolListener{
+		Listener: ln,
+		config:   r,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+func (r *AcceptProxyProtocol) isTrusted(addr net.Addr) bool {
+	ip, _ := addrIPPort(addr)
+	ip = normalizeIP(ip)
+	for _, prefix := range r.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	config *AcceptProxyProtocol
+	conns  chan net.Conn
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (r *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-r.conns:
+		return conn, nil
+	case err := <-r.errs:
+		return nil, err
+	case <-r.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (r *proxyProtocolListener) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return r.Listener.Close()
+}
+
+func (r *proxyProtocolListener) serve() {
+	for {
+		conn, err := r.Listener.Accept()
+		if err != nil {
+			select {
+			case r.errs <- err:
+			case <-r.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go r.handshake(conn)
+	}
+}
+
+func (r *proxyProtocolListener) handshake(conn net.Conn) {
+	if r.config.isTrusted(conn.RemoteAddr()) {
+		_ = conn.SetReadDeadline(time.Now().Add(r.config.Timeout))
+		wrapped, err := readProxyProtocolHeader(conn)
+		if err != nil {
+			logger.L.Sugar().Warnf("Invalid proxy protocol header from %s: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		conn = wrapped
+	}
+	select {
+	case r.conns <- conn:
+	case <-r.done:
+		_ = conn.Close()
+	}
+}
+
+// proxyProtocolConn is a connection whose addresses come from the PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (r *proxyProtocolConn) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+func (r *proxyProtocolConn) RemoteAddr() net.Addr {
+	return r.remoteAddr
+}
+
+func (r *proxyProtocolConn) LocalAddr() net.Addr {
+	return r.localAddr
+}
+
+// readProxyProtocolHeader reads the v1 or v2 header of conn, the addresses of conn are kept
+// for the LOCAL and UNKNOWN headers.
+func readProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+	wrapped := &proxyProtocolConn{
+		Conn:       conn,
+		reader:     bufio.NewReader(conn),
+		remoteAddr: conn.RemoteAddr(),
+		localAddr:  conn.LocalAddr(),
+	}
+	first, err := wrapped.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		err = wrapped.readV1()
+	case proxyProtocolV2Signature[0]:
+		err = wrapped.readV2()
+	default:
+		err = errors.New("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+func (r *proxyProtocolConn) readV1() error {
+	line, err := r.reader.ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+	if len(line) > proxyProtocolV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.New("invalid v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("invalid v1 header")
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return errors.New("invalid v1 header address")
+	}
+	r.remoteAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	r.localAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+func (r *proxyProtocolConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return errors.New("invalid v2 header")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return err
+	}
+	// LOCAL command, or the addresses other than tcp over IPv4 and IPv6
+	if header[12]&0x0f == 0 {
+		return nil
+	}
+	var ipLen int
+	switch header[13] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return errors.New("invalid v2 header address")
+	}
+	r.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	r.localAddr = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return nil
+}
+
+func checkProxyProtocol(version, protocol string) error {
+	switch version {
+	case "", ProxyProtocolV2:
+		return nil
+	case ProxyProtocolV1:
+		if protocol == "udp" {
+			return errors.New("proxy protocol v1 does not support udp")
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid proxy protocol %q", version)
+	}
+}
+
+// proxyProtocolHeader builds the PROXY protocol header telling the backend that
+// the client src connected to dst, protocol is tcp or udp. The family of the header follows src.
+func proxyProtocolHeader(version, protocol string, src, dst net.Addr) []byte {
+	srcIP, srcPort := addrIPPort(src)
+	dstIP, dstPort := addrIPPort(dst)
+	// the wildcard address of a dual-stack listener is IPv6, use the unspecified IPv4 address
+	// instead, so that the IPv4 clients are sent as IPv4
+	if srcIP.To4() != nil && dstIP != nil && dstIP.To4() == nil {
+		dstIP = net.IPv4zero
+	}
+	v4 := srcIP.To4() != nil
+	if version == ProxyProtocolV1 {
+		if srcIP == nil || dstIP == nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort))
+	}
+
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	if srcIP == nil || dstIP == nil {
+		// LOCAL command without addresses
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	// version 2, PROXY command
+	header = append(header, 0x21)
+	var family byte = 0x20
+	if v4 {
+		family = 0x10
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+	if protocol == "udp" {
+		family |= 0x02
+	} else {
+		family |= 0x01
+	}
+	header = append(header, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstPort))
+	return header
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	default:
+		return nil, 0
+	}
+}
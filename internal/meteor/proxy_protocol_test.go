@@ -0,0 +1,142 @@
+package meteor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// headerConn serves the bytes of a header as a connection.
+type headerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (r *headerConn) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+func (r *headerConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+}
+
+func (r *headerConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8080}
+}
+
+func v2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4Payload := append(append(net.ParseIP("1.2.3.4").To4(), net.ParseIP("5.6.7.8").To4()...), 0x30, 0x39, 0x01, 0xbb)
+	v6Payload := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+	badVersion := v2Header(0x01, 0x11, v4Payload)
+	badVersion[12] = 0x11
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+		err    bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 12345 443\r\n"), remote: "1.2.3.4:12345", local: "5.6.7.8:443"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), remote: "[2001:db8::1]:12345", local: "[2001:db8::2]:443"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n"), remote: "10.0.0.1:40000", local: "10.0.0.2:8080"},
+		{name: "v1 unknown with addresses", header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), remote: "10.0.0.1:40000", local: "10.0.0.2:8080"},
+		{name: "v1 without crlf", header: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 12345 443\n"), err: true},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 1.2.3.4"), err: true},
+		{name: "v1 oversized", header: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), err: true},
+		{name: "v1 oversized without newline", header: []byte("PROXY " + strings.Repeat("1", 5000)), err: true},
+		{name: "v1 invalid family", header: []byte("PROXY UDP4 1.2.3.4 5.6.7.8 12345 443\r\n"), err: true},
+		{name: "v1 invalid address", header: []byte("PROXY TCP4 1.2.3 5.6.7.8 12345 443\r\n"), err: true},
+		{name: "v1 invalid port", header: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 123456 443\r\n"), err: true},
+		{name: "v2 tcp4", header: v2Header(0x01, 0x11, v4Payload), remote: "1.2.3.4:12345", local: "5.6.7.8:443"},
+		{name: "v2 tcp6", header: v2Header(0x01, 0x21, v6Payload), remote: "[2001:db8::1]:12345", local: "[2001:db8::2]:443"},
+		{name: "v2 tcp4 with tlv", header: v2Header(0x01, 0x11, append(v4Payload, 0x04, 0x00, 0x01, 0xff)), remote: "1.2.3.4:12345", local: "5.6.7.8:443"},
+		{name: "v2 local", header: v2Header(0x00, 0x00, nil), remote: "10.0.0.1:40000", local: "10.0.0.2:8080"},
+		{name: "v2 unspec family", header: v2Header(0x01, 0x00, nil), remote: "10.0.0.1:40000", local: "10.0.0.2:8080"},
+		{name: "v2 short address", header: v2Header(0x01, 0x11, v4Payload[:8]), err: true},
+		{name: "v2 truncated payload", header: v2Header(0x01, 0x11, v4Payload)[:20], err: true},
+		{name: "v2 truncated header", header: v2Header(0x01, 0x11, v4Payload)[:10], err: true},
+		{name: "v2 invalid signature", header: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0x00, 0x00), err: true},
+		{name: "v2 invalid version", header: badVersion, err: true},
+		{name: "missing header", header: []byte("GET / HTTP/1.1\r\n"), err: true},
+		{name: "empty", header: nil, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := readProxyProtocolHeader(&headerConn{reader: bytes.NewReader(append(test.header, "data"...))})
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, remote %s", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote := conn.RemoteAddr().String(); remote != test.remote {
+				t.Errorf("remote %s, want %s", remote, test.remote)
+			}
+			if local := conn.LocalAddr().String(); local != test.local {
+				t.Errorf("local %s, want %s", local, test.local)
+			}
+			data, err := io.ReadAll(conn)
+			if err != nil || string(data) != "data" {
+				t.Errorf("data %q, err %v", data, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		version string
+		src     string
+		dst     string
+		remote  string
+		local   string
+	}{
+		{version: ProxyProtocolV1, src: "1.2.3.4:12345", dst: "5.6.7.8:443", remote: "1.2.3.4:12345", local: "5.6.7.8:443"},
+		{version: ProxyProtocolV2, src: "1.2.3.4:12345", dst: "5.6.7.8:443", remote: "1.2.3.4:12345", local: "5.6.7.8:443"},
+		{version: ProxyProtocolV2, src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:443", remote: "[2001:db8::1]:12345", local: "[2001:db8::2]:443"},
+		// an IPv4 client of a dual-stack listener
+		{version: ProxyProtocolV1, src: "1.2.3.4:12345", dst: "[::]:443", remote: "1.2.3.4:12345", local: "0.0.0.0:443"},
+		{version: ProxyProtocolV2, src: "[::ffff:1.2.3.4]:12345", dst: "[::]:443", remote: "1.2.3.4:12345", local: "0.0.0.0:443"},
+	}
+	for _, test := range tests {
+		src, _ := net.ResolveTCPAddr("tcp", test.src)
+		dst, _ := net.ResolveTCPAddr("tcp", test.dst)
+		header := proxyProtocolHeader(test.version, "tcp", src, dst)
+		conn, err := readProxyProtocolHeader(&headerConn{reader: bytes.NewReader(header)})
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.version, test.src, err)
+		}
+		if remote := conn.RemoteAddr().String(); remote != test.remote {
+			t.Errorf("%s %s: remote %s, want %s", test.version, test.src, remote, test.remote)
+		}
+		if local := conn.LocalAddr().String(); local != test.local {
+			t.Errorf("%s %s: local %s, want %s", test.version, test.src, local, test.local)
+		}
+	}
+}
+
+func TestProxyProtocolHeaderUDP(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 12345}
+	dst := &net.UDPAddr{IP: net.IPv6unspecified, Port: 53}
+	header := proxyProtocolHeader(ProxyProtocolV2, "udp", src, dst)
+	// IPv4 over udp
+	if header[13] != 0x12 {
+		t.Fatalf("family %#x, want 0x12", header[13])
+	}
+	if length := binary.BigEndian.Uint16(header[14:]); length != 12 {
+		t.Fatalf("length %d, want 12", length)
+	}
+}
@@ -0,0 +1,144 @@
+package meteor
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimit limits the new connections and the concurrent connections of every source,
+// the sources are grouped by prefix so that a whole subnet shares one limit.
+type RateLimit struct {
+	// Rate is the number of new connections per second, unlimited when zero
+	Rate float64 `yaml:"rate"`
+	// Burst is the max number of new connections at once, the rate rounded up by default
+	Burst int `yaml:"burst"`
+	// MaxConns is the max number of concurrent connections, unlimited when zero
+	MaxConns   int `yaml:"max_conns"`
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+}
+
+const (
+	DefaultRateLimitIPv4Prefix = 32
+	DefaultRateLimitIPv6Prefix = 64
+	rateLimitIdleTimeout       = 10 * time.Minute
+)
+
+func newRateLimiter(config RateLimit) (*rateLimiter, error) {
+	if config.Rate < 0 || config.Burst < 0 || config.MaxConns < 0 {
+		return nil, errors.New("rate limit must not be negative")
+	}
+	if config.Burst == 0 {
+		config.Burst = int(config.Rate)
+		if float64(config.Burst) < config.Rate {
+			config.Burst++
+		}
+	}
+	if config.IPv4Prefix == 0 {
+		config.IPv4Prefix = DefaultRateLimitIPv4Prefix
+	}
+	if config.IPv6Prefix == 0 {
+		config.IPv6Prefix = DefaultRateLimitIPv6Prefix
+	}
+	if config.IPv4Prefix > 8*net.IPv4len || config.IPv6Prefix > 8*net.IPv6len {
+		return nil, errors.New("invalid rate limit prefix")
+	}
+	limiter := rateLimiter{
+		config:  config,
+		sources: make(map[string]*rateLimitSource),
+	}
+	return &limiter, nil
+}
+
+type rateLimiter struct {
+	config RateLimit
+
+	mutex   sync.Mutex
+	sources map[string]*rateLimitSource
+}
+
+type rateLimitSource struct {
+	tokens float64
+	// last is when the tokens were refilled
+	last time.Time
+	// idle is when the source was last active, the idle sources are removed by Cleanup
+	idle  time.Time
+	conns int
+}
+
+// Acquire takes a token and a connection slot of the source of ip, it reports false when
+// the source is over the limit. Every successful Acquire must be followed by a Release.
+func (r *rateLimiter) Acquire(ip net.IP) bool {
+	key := r.key(ip)
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	source, ok := r.sources[key]
+	if !ok {
+		source = &rateLimitSource{
+			tokens: float64(r.config.Burst),
+			last:   now,
+		}
+		r.sources[key] = source
+	}
+	source.idle = now
+	if r.config.MaxConns > 0 && source.conns >= r.config.MaxConns {
+		return false
+	}
+	if r.config.Rate > 0 {
+		source.tokens += now.Sub(source.last).Seconds() * r.config.Rate
+		if source.tokens > float64(r.config.Burst) {
+			source.tokens = float64(r.config.Burst)
+		}
+		source.last = now
+		if source.tokens < 1 {
+			return false
+		}
+		source.tokens--
+	}
+	source.conns++
+	return true
+}
+
+func (r *rateLimiter) Release(ip net.IP) {
+	key := r.key(ip)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if source, ok := r.sources[key]; ok && source.conns > 0 {
+		source.conns--
+		source.idle = time.Now()
+	}
+}
+
+// Cleanup removes the idle sources periodically until ctx is done.
+func (r *rateLimiter) Cleanup(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.mutex.Lock()
+			for key, source := range r.sources {
+				if source.conns == 0 && now.Sub(source.idle) > rateLimitIdleTimeout {
+					delete(r.sources, key)
+				}
+			}
+			r.mutex.Unlock()
+		}
+	}
+}
+
+func (r *rateLimiter) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(r.config.IPv4Prefix, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(r.config.IPv6Prefix, 8*net.IPv6len)).String()
+}
@@ -1,58 +1,344 @@
 package meteor
 
 import (
+	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/pkg/iptrie"
 	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
 	"net"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// MatchAny matches when any condition of the rule matches
+	MatchAny = "any"
+	// MatchAll matches when all conditions of the rule match
+	MatchAll = "all"
 )
 
 type Rule struct {
-	IP      string `yaml:"ip"`
-	City    string `yaml:"city"`
+	IP string `yaml:"ip"`
+	// IPFile is a local file of ip addresses, one per line
+	IPFile        string        `yaml:"ip_file"`
+	IPFileRefresh time.Duration `yaml:"ip_file_refresh"`
+	// IPURL is a http url of ip addresses, one per line
+	IPURL        string        `yaml:"ip_url"`
+	IPURLRefresh time.Duration `yaml:"ip_url_refresh"`
+
+	City        string `yaml:"city"`
+	Subdivision string `yaml:"subdivision"`
+	Province    string `yaml:"province"` // alias of subdivision
+	Country     string `yaml:"country"`
+	Continent   string `yaml:"continent"`
+	ASN         string `yaml:"asn"`
+	Org         string `yaml:"org"`
+	Label       string `yaml:"label"`
+
+	// the not_ fields match when the client does not match the corresponding field
+	NotIP          string `yaml:"not_ip"`
+	NotCity        string `yaml:"not_city"`
+	NotSubdivision string `yaml:"not_subdivision"`
+	NotProvince    string `yaml:"not_province"`
+	NotCountry     string `yaml:"not_country"`
+	NotContinent   string `yaml:"not_continent"`
+	NotASN         string `yaml:"not_asn"`
+	NotOrg         string `yaml:"not_org"`
+	NotLabel       string `yaml:"not_label"`
+
+	// Match is any or all of the conditions above, any by default
+	Match   string `yaml:"match"`
 	Allowed bool   `yaml:"allowed"`
+	// Action is allow, deny or log, it overrides Allowed
+	Action string `yaml:"action"`
+	// Schedule limits the rule to time windows
+	Schedule *Schedule `yaml:"schedule"`
 
-	ipList   []net.IP
-	cidrList []*net.IPNet
+	action   string
+	matchAll bool
 
-	cityList []string
+	prefixes     []*net.IPNet
+	filePrefixes []*net.IPNet
+	urlPrefixes  []*net.IPNet
+	notPrefixes  []*net.IPNet
+
+	locations    locationMatcher
+	notLocations locationMatcher
 }
 
 func (r *Rule) Init() error {
-	parts := strings.Split(r.IP, ",")
-	for _, part := range parts {
-		if part == "" {
-			continue
+	switch r.Action {
+	case "":
+		r.action = ActionDeny
+		if r.Allowed {
+			r.action = ActionAllow
 		}
-		if strings.Contains(part, "/") {
-			_, cidr, err := net.ParseCIDR(part)
-			if err != nil {
+	case ActionAllow, ActionDeny, ActionLog:
+		r.action = r.Action
+	default:
+		return errors.Errorf("invalid action %q", r.Action)
+	}
+	switch r.Match {
+	case "", MatchAny:
+		r.matchAll = false
+	case MatchAll:
+		r.matchAll = true
+	default:
+		return errors.Errorf("invalid match %q", r.Match)
+	}
+	if r.Schedule != nil {
+		if err := r.Schedule.Init(); err != nil {
+			return errors.Wrap(err, "invalid schedule")
+		}
+	}
+
+	var err error
+	if r.prefixes, err = parsePrefixes(r.IP); err != nil {
+		return err
+	}
+	if r.notPrefixes, err = parsePrefixes(r.NotIP); err != nil {
+		return err
+	}
+	if r.IPFile != "" {
+		prefixes, err := readIPFile(r.IPFile)
+		if err != nil {
+			return err
+		}
+		r.filePrefixes = prefixes
+	}
+	if r.IPURL != "" {
+		prefixes, err := fetchIPURL(r.IPURL)
+		if err != nil {
+			// without ip_url_refresh the url is never fetched again
+			if r.IPURLRefresh <= 0 {
 				return err
 			}
-			r.cidrList = append(r.cidrList, cidr)
-		} else {
-			addr := net.ParseIP(part)
-			r.ipList = append(r.ipList, addr)
+			logger.L.Sugar().Warnf("error fetching ip url, fetching again in %s: %v", r.IPURLRefresh, err)
 		}
+		r.urlPrefixes = prefixes
 	}
 
-	if r.City != "" {
-		r.cityList = strings.Split(r.City, ",")
+	err = r.locations.init(r.City, r.Subdivision+","+r.Province, r.Country, r.Continent, r.ASN, r.Org, r.Label)
+	if err != nil {
+		return err
+	}
+	err = r.notLocations.init(r.NotCity, r.NotSubdivision+","+r.NotProvince, r.NotCountry, r.NotContinent, r.NotASN, r.NotOrg, r.NotLabel)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
-func (r *Rule) MatchIP(x net.IP) bool {
+// Active reports whether the schedule of the rule is active at t, a rule without schedule is always active.
+func (r *Rule) Active(t time.Time) bool {
+	return r.Schedule == nil || r.Schedule.Active(t)
+}
+
+// HasIP reports whether the rule has ip conditions.
+func (r *Rule) HasIP() bool {
+	return r.IP != "" || r.IPFile != "" || r.IPURL != ""
+}
+
+// HasLocation reports whether the rule needs the location of the client to be matched.
+func (r *Rule) HasLocation() bool {
+	return r.locations.count() > 0 || r.notLocations.count() > 0
+}
+
+// conditionCount returns the number of conditions of the rule.
+func (r *Rule) conditionCount() int {
+	count := r.locations.count() + r.notLocations.count()
+	if r.HasIP() {
+		count++
+	}
+	if len(r.notPrefixes) > 0 {
+		count++
+	}
+	return count
+}
+
+// matches combines the conditions of the rule by any or all. ipMatched and notIPMatched are
+// the results of the prefix trie, lookup returns the location of the client, which may be nil.
+// The rule is skipped when it depends on an unknown location.
+func (r *Rule) matches(ipMatched, notIPMatched bool, lookup func() *location.Info) bool {
+	var results []bool
+	if r.HasIP() {
+		results = append(results, ipMatched)
+	}
+	if len(r.notPrefixes) > 0 {
+		results = append(results, !notIPMatched)
+	}
+	if decided, matched := r.combine(results, false); decided {
+		return matched
+	}
+
+	if r.HasLocation() {
+		info := lookup()
+		if info == nil {
+			return false
+		}
+		results = append(results, r.locations.match(info)...)
+		for _, matched := range r.notLocations.match(info) {
+			results = append(results, !matched)
+		}
+	}
+	_, matched := r.combine(results, true)
+	return matched
+}
+
+// combine reports whether the results decide the rule, final is true when no more results follow.
+func (r *Rule) combine(results []bool, final bool) (decided bool, matched bool) {
+	for _, result := range results {
+		if r.matchAll && !result {
+			return true, false
+		}
+		if !r.matchAll && result {
+			return true, true
+		}
+	}
+	if !final {
+		return false, false
+	}
+	// all of nothing matches, any of nothing does not
+	return true, r.matchAll
+}
+
+// locationMatcher matches the location fields of a rule.
+type locationMatcher struct {
+	cityList        []string
+	subdivisionList []string
+	countryList     []string
+	continentList   []string
+
+	asnList []uint
+	orgList []string
+
+	labelList []string
+}
+
+func (r *locationMatcher) init(city, subdivision, country, continent, asn, org, label string) error {
+	r.cityList = splitList(city)
+	r.subdivisionList = splitList(subdivision)
+	r.countryList = splitList(country)
+	r.continentList = splitList(continent)
+
+	for _, part := range splitList(asn) {
+		number := strings.TrimPrefix(strings.ToUpper(part), "AS")
+		asn, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "invalid asn %s", part)
+		}
+		r.asnList = append(r.asnList, uint(asn))
+	}
+	r.orgList = splitList(org)
+	r.labelList = splitList(label)
+	return nil
+}
+
+// count returns the number of non-empty fields.
+func (r *locationMatcher) count() int {
+	var count int
+	for _, size := range []int{len(r.cityList), len(r.subdivisionList), len(r.countryList), len(r.continentList),
+		len(r.asnList), len(r.orgList), len(r.labelList)} {
+		if size > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// match returns whether info matches each non-empty field.
+func (r *locationMatcher) match(info *location.Info) []bool {
+	var results []bool
+	if len(r.cityList) > 0 {
+		results = append(results, r.MatchCity(info.City.Names))
+	}
+	if len(r.subdivisionList) > 0 {
+		results = append(results, r.MatchSubdivision(info.Country, info.Subdivisions))
+	}
+	if len(r.countryList) > 0 {
+		results = append(results, r.MatchCountry(info.Country))
+	}
+	if len(r.continentList) > 0 {
+		results = append(results, r.MatchContinent(info.Continent))
+	}
+	if len(r.asnList) > 0 {
+		results = append(results, r.MatchASN(info.ASN))
+	}
+	if len(r.orgList) > 0 {
+		results = append(results, r.MatchOrg(info.Org) || r.MatchOrg(info.ISP))
+	}
+	if len(r.labelList) > 0 {
+		results = append(results, r.MatchLabel(info.Labels))
+	}
+	return results
+}
+
+func (r *locationMatcher) MatchCity(names map[string]string) bool {
+	sugar := logger.L.Sugar()
+	for _, name := range names {
+		for _, city := range r.cityList {
+			b := strings.EqualFold(city, name)
+			sugar.Debugf("Matching city: %v equal %v = %v", city, name, b)
+			if b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchSubdivision matches the subdivisions by iso code (XJ or CN-XJ) or by localized name.
+func (r *locationMatcher) MatchSubdivision(country location.Place, subdivisions []location.Place) bool {
+	for _, subdivision := range subdivisions {
+		if matchPlace("subdivision", r.subdivisionList, subdivision) {
+			return true
+		}
+		if subdivision.Code == "" || country.Code == "" {
+			continue
+		}
+		code := country.Code + "-" + subdivision.Code
+		for _, item := range r.subdivisionList {
+			if strings.EqualFold(item, code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *locationMatcher) MatchCountry(country location.Place) bool {
+	return matchPlace("country", r.countryList, country)
+}
+
+func (r *locationMatcher) MatchContinent(continent location.Place) bool {
+	return matchPlace("continent", r.continentList, continent)
+}
+
+func (r *locationMatcher) MatchASN(asn uint) bool {
 	sugar := logger.L.Sugar()
-	for _, addr := range r.ipList {
-		b := addr.Equal(x)
-		sugar.Debugf("Matching ip: %v equal %v = %v", addr, x, b)
+	if asn == 0 {
+		return false
+	}
+	for _, item := range r.asnList {
+		b := item == asn
+		sugar.Debugf("Matching asn: AS%v equal AS%v = %v", item, asn, b)
 		if b {
 			return true
 		}
 	}
-	for _, cidr := range r.cidrList {
-		b := cidr.Contains(x)
-		sugar.Debugf("Matching cidr: %v contains %v = %v", cidr, x, b)
+	return false
+}
+
+// MatchOrg matches the organization of the autonomous system or the ISP, case-insensitive substring.
+func (r *locationMatcher) MatchOrg(org string) bool {
+	sugar := logger.L.Sugar()
+	if org == "" {
+		return false
+	}
+	for _, item := range r.orgList {
+		b := strings.Contains(strings.ToLower(org), strings.ToLower(item))
+		sugar.Debugf("Matching org: %v contains %v = %v", org, item, b)
 		if b {
 			return true
 		}
@@ -60,12 +346,30 @@ func (r *Rule) MatchIP(x net.IP) bool {
 	return false
 }
 
-func (r *Rule) MatchCity(names map[string]string) bool {
+func (r *locationMatcher) MatchLabel(labels []string) bool {
 	sugar := logger.L.Sugar()
-	for _, name := range names {
-		for _, city := range r.cityList {
-			b := strings.EqualFold(city, name)
-			sugar.Debugf("Matching city: %v equal %v = %v", city, name, b)
+	for _, label := range labels {
+		for _, item := range r.labelList {
+			b := strings.EqualFold(item, label)
+			sugar.Debugf("Matching label: %v equal %v = %v", item, label, b)
+			if b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchPlace(kind string, list []string, place location.Place) bool {
+	sugar := logger.L.Sugar()
+	for _, item := range list {
+		if place.Code != "" && strings.EqualFold(item, place.Code) {
+			sugar.Debugf("Matching %s: %v equal %v = true", kind, item, place.Code)
+			return true
+		}
+		for _, name := range place.Names {
+			b := strings.EqualFold(item, name)
+			sugar.Debugf("Matching %s: %v equal %v = %v", kind, item, name, b)
 			if b {
 				return true
 			}
@@ -73,3 +377,37 @@ func (r *Rule) MatchCity(names map[string]string) bool {
 	}
 	return false
 }
+
+var (
+	anyIPv4 = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)}
+	anyIPv6 = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+)
+
+// parsePrefixes parses a comma separated list of ip addresses and CIDRs, any means all IPv4 and IPv6 addresses.
+func parsePrefixes(s string) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for _, part := range splitList(s) {
+		if strings.EqualFold(part, "any") {
+			prefixes = append(prefixes, anyIPv4, anyIPv6)
+			continue
+		}
+		prefix, err := iptrie.ParsePrefix(part)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		list = append(list, part)
+	}
+	return list
+}
@@ -1,38 +1,222 @@
 package meteor
 
 import (
+	"context"
 	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/pkg/iptrie"
 	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
 	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type RuleSet []Rule
+// RuleSet is an ordered list of rules, the first matching rule wins.
+// The ip addresses of all rules are compiled into a prefix trie by Init.
+type RuleSet struct {
+	Rules []Rule `yaml:"rules"`
 
-func (r RuleSet) Allowed(ip net.IP, ipLocation location.Location) bool {
-	sugar := logger.L.Sugar()
-	for _, rule := range r {
-		if rule.IP != "" {
-			if rule.MatchIP(ip) {
-				sugar.Debugf("Matching IP succeeded, allowed: %v", rule.Allowed)
-				return rule.Allowed
+	name string
+	// defaultDenied is the verdict when no rule matches, allowed by default
+	defaultDenied bool
+	compiled      *compiledRuleSet
+}
+
+type compiledRuleSet struct {
+	// mutex serializes the refreshes of the external ip lists
+	mutex sync.Mutex
+	// trie maps every prefix to the rules containing it
+	trie atomic.Pointer[iptrie.Trie[ruleRef]]
+}
+
+// ruleRef refers to the ip or the not_ip addresses of a rule.
+type ruleRef struct {
+	index   int
+	negated bool
+}
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+	// ActionLog logs the matching clients and continues evaluating the following rules
+	ActionLog = "log"
+)
+
+// ruleSetDecodeHook decodes the yaml list of rules into a RuleSet.
+func ruleSetDecodeHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(RuleSet{}) || from.Kind() != reflect.Slice {
+		return data, nil
+	}
+	return map[string]interface{}{"rules": data}, nil
+}
+
+// Init parses the rules and compiles the ip addresses, name identifies the rule set in logs.
+func (r *RuleSet) Init(name, defaultAction string) error {
+	r.name = name
+	switch defaultAction {
+	case "", ActionAllow:
+		r.defaultDenied = false
+	case ActionDeny:
+		r.defaultDenied = true
+	default:
+		return errors.Errorf("invalid default action %q", defaultAction)
+	}
+	for i := range r.Rules {
+		if err := r.Rules[i].Init(); err != nil {
+			return errors.Wrapf(err, "rule #%d", i)
+		}
+	}
+	r.compiled = &compiledRuleSet{}
+	r.compile()
+	if len(r.Rules) > 0 && defaultAction == "" && !r.HasCatchAll() {
+		logger.L.Sugar().Warnf("The %s has rules but no default_action, clients matching no rule are allowed", name)
+	}
+	return nil
+}
+
+// compile builds the prefix trie of all rules and swaps it in atomically.
+func (r RuleSet) compile() {
+	trie := iptrie.New[ruleRef]()
+	for i, rule := range r.Rules {
+		for _, prefixes := range [][]*net.IPNet{rule.prefixes, rule.filePrefixes, rule.urlPrefixes} {
+			for _, prefix := range prefixes {
+				trie.Insert(prefix, ruleRef{index: i})
 			}
 		}
+		for _, prefix := range rule.notPrefixes {
+			trie.Insert(prefix, ruleRef{index: i, negated: true})
+		}
+	}
+	r.compiled.trie.Store(trie)
+}
 
-		if rule.City != "" {
+// Refresh reloads the ip_file and fetches the ip_url of the rules periodically until ctx is done.
+func (r RuleSet) Refresh(ctx context.Context) {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.IPFile != "" && rule.IPFileRefresh > 0 {
+			go refreshEvery(ctx, rule.IPFileRefresh, rule.IPFile, func() error {
+				prefixes, err := readIPFile(rule.IPFile)
+				if err != nil {
+					return err
+				}
+				r.compiled.mutex.Lock()
+				defer r.compiled.mutex.Unlock()
+				rule.filePrefixes = prefixes
+				r.compile()
+				return nil
+			})
+		}
+		if rule.IPURL != "" && rule.IPURLRefresh > 0 {
+			go refreshEvery(ctx, rule.IPURLRefresh, rule.IPURL, func() error {
+				prefixes, err := fetchIPURL(rule.IPURL)
+				if err != nil {
+					return err
+				}
+				r.compiled.mutex.Lock()
+				defer r.compiled.mutex.Unlock()
+				rule.urlPrefixes = prefixes
+				r.compile()
+				return nil
+			})
+		}
+	}
+}
+
+func (r RuleSet) Allowed(ip net.IP, ipLocation location.Location) bool {
+	_, allowed := r.Match(ip, ipLocation)
+	return allowed
+}
+
+// Match returns the index of the first matching allow or deny rule and whether the ip is allowed,
+// the index is -1 when no such rule matches. The matching log rules are logged and skipped.
+func (r RuleSet) Match(ip net.IP, ipLocation location.Location) (int, bool) {
+	sugar := logger.L.Sugar()
+	if len(r.Rules) == 0 {
+		return -1, !r.defaultDenied
+	}
+
+	ip = normalizeIP(ip)
+	ipMatched, notIPMatched := r.matchIP(ip)
+	var (
+		info       *location.Info
+		infoLoaded bool
+	)
+	lookup := func() *location.Info {
+		if !infoLoaded {
+			infoLoaded = true
 			if ipLocation == nil {
-				sugar.Warn("Matching city skip, ip location not configed")
-				continue
+				sugar.Warn("Matching location skip, ip location not configed")
+				return nil
 			}
-			city, err := ipLocation.City(ip)
+			var err error
+			info, err = ipLocation.Lookup(ip)
 			if err != nil {
-				sugar.Warnf("Matching city err: %v", err)
-				continue
+				sugar.Warnf("Matching location err: %v", err)
 			}
-			if rule.MatchCity(city) {
-				sugar.Debugf("Matching city succeeded, allowed: %v", rule.Allowed)
-				return rule.Allowed
+		}
+		return info
+	}
+	now := time.Now()
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if !rule.Active(now) {
+			continue
+		}
+		if !rule.matches(ipMatched[i], notIPMatched[i], lookup) {
+			continue
+		}
+		if rule.action == ActionLog {
+			sugar.Infof("Rule #%d of %s matched %v, location: %s", i, r.name, ip, lookup())
+			continue
+		}
+		sugar.Debugf("Rule #%d of %s matched %v, action: %v", i, r.name, ip, rule.action)
+		return i, rule.action == ActionAllow
+	}
+	return -1, !r.defaultDenied
+}
+
+// HasCatchAll reports whether a rule matches every IPv4 and IPv6 address,
+// so that the default action is never taken.
+func (r RuleSet) HasCatchAll() bool {
+	for _, rule := range r.Rules {
+		if rule.action == ActionLog || rule.Schedule != nil {
+			continue
+		}
+		if rule.matchAll && rule.conditionCount() > 1 {
+			continue
+		}
+		var v4, v6 bool
+		for _, prefix := range rule.prefixes {
+			if ones, bits := prefix.Mask.Size(); ones == 0 {
+				v4 = v4 || bits == 8*net.IPv4len
+				v6 = v6 || bits == 8*net.IPv6len
 			}
 		}
+		if v4 && v6 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIP reports for every rule whether any of its ip and not_ip addresses contains ip.
+func (r RuleSet) matchIP(ip net.IP) (matched []bool, notMatched []bool) {
+	matched = make([]bool, len(r.Rules))
+	notMatched = make([]bool, len(r.Rules))
+	if r.compiled == nil {
+		return matched, notMatched
 	}
-	return true
+	r.compiled.trie.Load().Match(ip, func(refs []ruleRef) {
+		for _, ref := range refs {
+			if ref.negated {
+				notMatched[ref.index] = true
+			} else {
+				matched[ref.index] = true
+			}
+		}
+	})
+	return matched, notMatched
 }
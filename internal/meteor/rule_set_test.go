@@ -0,0 +1,201 @@
+package meteor
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dushxiiang/meteor/internal/location"
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// fixedLocation returns the same location for every ip, nil info is an unknown location.
+type fixedLocation struct {
+	info *location.Info
+}
+
+func (r fixedLocation) Lookup(net.IP) (*location.Info, error) {
+	return r.info, nil
+}
+
+var (
+	chengduTelecom = &location.Info{
+		City:    location.Place{Names: map[string]string{"en": "Chengdu", "zh-CN": "成都市"}},
+		Country: location.Place{Code: "CN", Names: map[string]string{"en": "China"}},
+		ASN:     4134,
+	}
+	beijingMobile = &location.Info{
+		City:    location.Place{Names: map[string]string{"en": "Beijing", "zh-CN": "北京市"}},
+		Country: location.Place{Code: "CN", Names: map[string]string{"en": "China"}},
+		ASN:     9808,
+	}
+)
+
+func TestRuleMatches(t *testing.T) {
+	logger.L = zap.NewNop()
+	tests := []struct {
+		name         string
+		rule         Rule
+		ipMatched    bool
+		notIPMatched bool
+		info         *location.Info
+		matched      bool
+	}{
+		// any is the default, an ip or a city rule matches like before
+		{name: "any ip only", rule: Rule{IP: "10.0.0.0/8", City: "chengdu"}, ipMatched: true, info: beijingMobile, matched: true},
+		{name: "any city only", rule: Rule{IP: "10.0.0.0/8", City: "chengdu"}, info: chengduTelecom, matched: true},
+		{name: "any neither", rule: Rule{IP: "10.0.0.0/8", City: "chengdu"}, info: beijingMobile, matched: false},
+		{name: "any ip with unknown location", rule: Rule{IP: "10.0.0.0/8", City: "chengdu"}, ipMatched: true, matched: true},
+		{name: "all not_asn other asn", rule: Rule{Match: MatchAll, IP: "10.0.0.0/8", NotASN: "AS4134"}, ipMatched: true, info: beijingMobile, matched: true},
+		{name: "all not_asn same asn", rule: Rule{Match: MatchAll, IP: "10.0.0.0/8", NotASN: "AS4134"}, ipMatched: true, info: chengduTelecom, matched: false},
+		{name: "all not_asn other ip", rule: Rule{Match: MatchAll, IP: "10.0.0.0/8", NotASN: "AS4134"}, info: beijingMobile, matched: false},
+		{name: "lone not_ip outside", rule: Rule{NotIP: "192.168.0.0/16"}, matched: true},
+		{name: "lone not_ip inside", rule: Rule{NotIP: "192.168.0.0/16"}, notIPMatched: true, matched: false},
+		// the rules depending on an unknown location are skipped
+		{name: "unknown location city", rule: Rule{City: "chengdu"}, matched: false},
+		{name: "unknown location not_city", rule: Rule{NotCity: "chengdu"}, matched: false},
+		{name: "unknown location all", rule: Rule{Match: MatchAll, IP: "10.0.0.0/8", NotCountry: "US"}, ipMatched: true, matched: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := test.rule
+			if err := rule.Init(); err != nil {
+				t.Fatal(err)
+			}
+			lookup := func() *location.Info {
+				return test.info
+			}
+			if matched := rule.matches(test.ipMatched, test.notIPMatched, lookup); matched != test.matched {
+				t.Errorf("matched %v, want %v", matched, test.matched)
+			}
+		})
+	}
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	logger.L = zap.NewNop()
+	tests := []struct {
+		name          string
+		rules         []Rule
+		defaultAction string
+		ip            string
+		location      location.Location
+		index         int
+		allowed       bool
+	}{
+		{
+			name:          "ip or city by ip",
+			rules:         []Rule{{IP: "10.0.0.0/8", City: "chengdu", Allowed: true}},
+			defaultAction: ActionDeny,
+			ip:            "10.1.1.1",
+			location:      fixedLocation{beijingMobile},
+			index:         0,
+			allowed:       true,
+		},
+		{
+			name:          "ip or city by city",
+			rules:         []Rule{{IP: "10.0.0.0/8", City: "chengdu", Allowed: true}},
+			defaultAction: ActionDeny,
+			ip:            "8.8.8.8",
+			location:      fixedLocation{chengduTelecom},
+			index:         0,
+			allowed:       true,
+		},
+		{
+			name:          "ip or city by default",
+			rules:         []Rule{{IP: "10.0.0.0/8", City: "chengdu", Allowed: true}},
+			defaultAction: ActionDeny,
+			ip:            "8.8.8.8",
+			location:      fixedLocation{beijingMobile},
+			index:         -1,
+			allowed:       false,
+		},
+		{
+			name:     "all with not_asn denied",
+			rules:    []Rule{{Match: MatchAll, IP: "10.0.0.0/8", NotASN: "AS4134", Action: ActionDeny}},
+			ip:       "10.0.0.1",
+			location: fixedLocation{beijingMobile},
+			index:    0,
+			allowed:  false,
+		},
+		{
+			name:     "all with not_asn excluded asn",
+			rules:    []Rule{{Match: MatchAll, IP: "10.0.0.0/8", NotASN: "AS4134", Action: ActionDeny}},
+			ip:       "10.0.0.1",
+			location: fixedLocation{chengduTelecom},
+			index:    -1,
+			allowed:  true,
+		},
+		{
+			name:    "lone not_ip outside",
+			rules:   []Rule{{NotIP: "192.168.0.0/16", Action: ActionDeny}},
+			ip:      "8.8.8.8",
+			index:   0,
+			allowed: false,
+		},
+		{
+			name:    "lone not_ip inside",
+			rules:   []Rule{{NotIP: "192.168.0.0/16", Action: ActionDeny}},
+			ip:      "192.168.1.1",
+			index:   -1,
+			allowed: true,
+		},
+		{
+			name:     "unknown location skips the rule",
+			rules:    []Rule{{City: "chengdu", Action: ActionDeny}, {IP: "any", Allowed: true}},
+			ip:       "8.8.8.8",
+			location: fixedLocation{},
+			index:    1,
+			allowed:  true,
+		},
+		{
+			name:    "no location provider skips the rule",
+			rules:   []Rule{{NotCountry: "CN", Action: ActionDeny}, {IP: "any", Allowed: true}},
+			ip:      "8.8.8.8",
+			index:   1,
+			allowed: true,
+		},
+		{
+			name:     "log rule continues",
+			rules:    []Rule{{Country: "CN", Action: ActionLog}, {IP: "10.0.0.0/8", Action: ActionDeny}, {IP: "any", Allowed: true}},
+			ip:       "10.0.0.1",
+			location: fixedLocation{chengduTelecom},
+			index:    1,
+			allowed:  false,
+		},
+		{
+			name:     "log rule then catch-all",
+			rules:    []Rule{{Country: "CN", Action: ActionLog}, {IP: "10.0.0.0/8", Action: ActionDeny}, {IP: "any", Allowed: true}},
+			ip:       "8.8.8.8",
+			location: fixedLocation{chengduTelecom},
+			index:    2,
+			allowed:  true,
+		},
+		{
+			name:    "first match wins",
+			rules:   []Rule{{IP: "any", Allowed: true}, {IP: "10.0.0.0/8", Action: ActionDeny}},
+			ip:      "10.0.0.1",
+			index:   0,
+			allowed: true,
+		},
+		{
+			name:    "IPv4-mapped IPv6 client",
+			rules:   []Rule{{IP: "10.0.0.0/8", Action: ActionDeny}},
+			ip:      "::ffff:10.0.0.1",
+			index:   0,
+			allowed: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := RuleSet{Rules: append([]Rule(nil), test.rules...)}
+			if err := rules.Init("test", test.defaultAction); err != nil {
+				t.Fatal(err)
+			}
+			index, allowed := rules.Match(net.ParseIP(test.ip), test.location)
+			if index != test.index || allowed != test.allowed {
+				t.Errorf("matched #%d allowed %v, want #%d allowed %v", index, allowed, test.index, test.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package meteor
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule limits a rule to time windows, the rule only takes part in matching while the window is active.
+type Schedule struct {
+	// Days are the days of week, such as mon,tue or mon-fri, every day when empty
+	Days string `yaml:"days"`
+	// Times are the time ranges of day, such as 09:00-12:00,14:00-18:00 or 22:00-06:00, all day when empty
+	Times string `yaml:"times"`
+	// Timezone is an IANA time zone name, the local time zone when empty
+	Timezone string `yaml:"timezone"`
+
+	days     [7]bool
+	ranges   []timeRange
+	location *time.Location
+}
+
+// timeRange is a range of minutes of day, end is exclusive and may be less than start across midnight.
+type timeRange struct {
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (r *Schedule) Init() error {
+	r.location = time.Local
+	if r.Timezone != "" {
+		location, err := time.LoadLocation(r.Timezone)
+		if err != nil {
+			return err
+		}
+		r.location = location
+	}
+
+	days := splitList(r.Days)
+	if len(days) == 0 {
+		days = []string{"sun-sat"}
+	}
+	for _, day := range days {
+		from, to, _ := strings.Cut(strings.ToLower(day), "-")
+		if to == "" {
+			to = from
+		}
+		start, ok := weekdays[from]
+		if !ok {
+			return errors.Errorf("invalid day %q", day)
+		}
+		end, ok := weekdays[to]
+		if !ok {
+			return errors.Errorf("invalid day %q", day)
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			r.days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+
+	for _, item := range splitList(r.Times) {
+		from, to, ok := strings.Cut(item, "-")
+		if !ok {
+			return errors.Errorf("invalid time range %q", item)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return err
+		}
+		r.ranges = append(r.ranges, timeRange{start: start, end: end})
+	}
+	return nil
+}
+
+// Active reports whether t is inside the schedule. The part of a range after midnight
+// belongs to the day the range started, so fri 22:00-06:00 is active until saturday 06:00.
+func (r *Schedule) Active(t time.Time) bool {
+	t = t.In(r.location)
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	if len(r.ranges) == 0 {
+		return r.days[today]
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, rng := range r.ranges {
+		if rng.start <= rng.end {
+			if r.days[today] && minute >= rng.start && minute < rng.end {
+				return true
+			}
+			continue
+		}
+		if r.days[today] && minute >= rng.start {
+			return true
+		}
+		if r.days[yesterday] && minute < rng.end {
+			return true
+		}
+	}
+	return false
+}
+
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
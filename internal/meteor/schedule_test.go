@@ -0,0 +1,73 @@
+package meteor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// 2026-10-16 is a friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		days   string
+		times  string
+		t      time.Time
+		active bool
+	}{
+		{name: "overnight friday evening", days: "fri", times: "22:00-06:00", t: at(16, 23, 0), active: true},
+		{name: "overnight saturday morning", days: "fri", times: "22:00-06:00", t: at(17, 3, 0), active: true},
+		{name: "overnight saturday after end", days: "fri", times: "22:00-06:00", t: at(17, 7, 0), active: false},
+		{name: "overnight thursday morning", days: "fri", times: "22:00-06:00", t: at(15, 3, 0), active: false},
+		{name: "overnight friday morning", days: "fri", times: "22:00-06:00", t: at(16, 3, 0), active: false},
+		{name: "overnight end is exclusive", days: "fri", times: "22:00-06:00", t: at(17, 6, 0), active: false},
+		{name: "24:00 end last minute", days: "fri", times: "18:00-24:00", t: at(16, 23, 59), active: true},
+		{name: "24:00 end before start", days: "fri", times: "18:00-24:00", t: at(16, 17, 59), active: false},
+		{name: "24:00 end next day", days: "fri", times: "18:00-24:00", t: at(17, 0, 0), active: false},
+		{name: "wraparound friday", days: "fri-mon", t: at(16, 12, 0), active: true},
+		{name: "wraparound sunday", days: "fri-mon", t: at(18, 12, 0), active: true},
+		{name: "wraparound monday", days: "fri-mon", t: at(19, 23, 59), active: true},
+		{name: "wraparound tuesday", days: "fri-mon", t: at(20, 0, 0), active: false},
+		{name: "wraparound thursday", days: "fri-mon", t: at(15, 12, 0), active: false},
+		{name: "every day", times: "09:00-17:00", t: at(14, 9, 0), active: true},
+		{name: "several ranges", days: "mon-fri", times: "09:00-12:00, 14:00-18:00", t: at(16, 13, 0), active: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := Schedule{Days: test.days, Times: test.times, Timezone: "UTC"}
+			if err := schedule.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if active := schedule.Active(test.t); active != test.active {
+				t.Errorf("active %v, want %v", active, test.active)
+			}
+		})
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	schedule := Schedule{Days: "sat", Times: "07:00-08:00", Timezone: "Asia/Shanghai"}
+	if err := schedule.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// saturday 07:30 in Shanghai is friday 23:30 UTC
+	if !schedule.Active(time.Date(2026, 10, 16, 23, 30, 0, 0, time.UTC)) {
+		t.Error("expected active in the schedule timezone")
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, schedule := range []Schedule{
+		{Days: "fri-sun-mon"},
+		{Days: "friday"},
+		{Times: "22:00"},
+		{Times: "25:00-26:00"},
+		{Timezone: "Mars/Olympus"},
+	} {
+		if err := schedule.Init(); err == nil {
+			t.Errorf("expected error for %+v", schedule)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package meteor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dushxiiang/meteor/pkg/iptrie"
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/pkg/errors"
+)
+
+type ThreatIntelConfig struct {
+	Feeds []FeedConfig `yaml:"feeds"`
+	// Export exports the clients banned or denied repeatedly by meteor
+	Export *ExportConfig `yaml:"export"`
+	// StatsInterval logs the stats of the feeds periodically, disabled when zero
+	StatsInterval time.Duration `yaml:"stats_interval"`
+}
+
+// FeedConfig is an ip reputation feed, loaded from either a url or a local file.
+type FeedConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	File string `yaml:"file"`
+	// Format is netset, list or json, netset by default
+	Format  string        `yaml:"format"`
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+const (
+	FeedFormatNetset = "netset"
+	FeedFormatList   = "list"
+	FeedFormatJSON   = "json"
+
+	DefaultFeedRefresh = time.Hour
+)
+
+type FeedStats struct {
+	Name        string
+	Entries     int
+	Hits        uint64
+	LastRefresh time.Time
+	LastError   string
+}
+
+func NewThreatIntel(config ThreatIntelConfig) (*ThreatIntel, error) {
+	intel := ThreatIntel{
+		config: config,
+	}
+	for i, feed := range config.Feeds {
+		if feed.Name == "" {
+			feed.Name = feed.URL + feed.File
+		}
+		if (feed.URL == "") == (feed.File == "") {
+			return nil, errors.Errorf("feed %s requires either url or file", feed.Name)
+		}
+		switch feed.Format {
+		case "":
+			feed.Format = FeedFormatNetset
+		case FeedFormatNetset, FeedFormatList, FeedFormatJSON:
+		default:
+			return nil, errors.Errorf("feed %s has invalid format %q", feed.Name, feed.Format)
+		}
+		if feed.Refresh <= 0 {
+			feed.Refresh = DefaultFeedRefresh
+		}
+		intel.config.Feeds[i] = feed
+		intel.feeds = append(intel.feeds, &threatFeed{config: feed})
+	}
+	intel.trie.Store(iptrie.New[*threatFeed]())
+	return &intel, nil
+}
+
+// ThreatIntel is the global deny set built from the ip reputation feeds.
+type ThreatIntel struct {
+	config ThreatIntelConfig
+	feeds  []*threatFeed
+
+	// mutex serializes the rebuilds of the trie
+	mutex sync.Mutex
+	trie  atomic.Pointer[iptrie.Trie[*threatFeed]]
+}
+
+type threatFeed struct {
+	config FeedConfig
+	hits   atomic.Uint64
+
+	// guarded by ThreatIntel.mutex
+	prefixes    []*net.IPNet
+	lastRefresh time.Time
+	lastError   string
+}
+
+// Load loads every feed once, the feeds are loaded concurrently.
+func (r *ThreatIntel) Load() {
+	var wg sync.WaitGroup
+	for _, feed := range r.feeds {
+		wg.Add(1)
+		go func(feed *threatFeed) {
+			defer wg.Done()
+			r.load(feed)
+		}(feed)
+	}
+	wg.Wait()
+}
+
+func (r *ThreatIntel) load(feed *threatFeed) {
+	if err := r.refresh(feed); err != nil {
+		logger.L.Sugar().Warnf("error loading threat intel feed %s: %v", feed.config.Name, err)
+	}
+}
+
+// Run loads every feed in the background and refreshes it periodically until ctx is done,
+// the clients are not checked against a feed until it is loaded.
+func (r *ThreatIntel) Run(ctx context.Context) {
+	for _, feed := range r.feeds {
+		feed := feed
+		go func() {
+			r.load(feed)
+			refreshEvery(ctx, feed.config.Refresh, "threat intel feed "+feed.config.Name, func() error {
+				return r.refresh(feed)
+			})
+		}()
+	}
+	if r.config.StatsInterval > 0 {
+		go r.logStats(ctx, r.config.StatsInterval)
+	}
+}
+
+// Listed returns the name of the first feed listing ip.
+func (r *ThreatIntel) Listed(ip net.IP) (string, bool) {
+	feeds := r.trie.Load().Longest(ip)
+	if len(feeds) == 0 {
+		return "", false
+	}
+	feeds[0].hits.Add(1)
+	return feeds[0].config.Name, true
+}
+
+func (r *ThreatIntel) Stats() []FeedStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var stats []FeedStats
+	for _, feed := range r.feeds {
+		stats = append(stats, FeedStats{
+			Name:        feed.config.Name,
+			Entries:     len(feed.prefixes),
+			Hits:        feed.hits.Load(),
+			LastRefresh: feed.lastRefresh,
+			LastError:   feed.lastError,
+		})
+	}
+	return stats
+}
+
+func (r *ThreatIntel) refresh(feed *threatFeed) error {
+	sugar := logger.L.Sugar()
+	prefixes, err := loadFeed(feed.config)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		feed.lastError = err.Error()
+		return err
+	}
+	feed.prefixes = prefixes
+	feed.lastRefresh = time.Now()
+	feed.lastError = ""
+
+	trie := iptrie.New[*threatFeed]()
+	for _, item := range r.feeds {
+		for _, prefix := range item.prefixes {
+			trie.Insert(prefix, item)
+		}
+	}
+	r.trie.Store(trie)
+	sugar.Infof("Threat intel feed %s loaded, entries: %d", feed.config.Name, len(prefixes))
+	return nil
+}
+
+func (r *ThreatIntel) logStats(ctx context.Context, interval time.Duration) {
+	sugar := logger.L.Sugar()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, stats := range r.Stats() {
+				sugar.Infof("Threat intel feed %s stats, entries: %d, hits: %d, last refresh: %s, last error: %s",
+					stats.Name, stats.Entries, stats.Hits, stats.LastRefresh.Format(time.DateTime), stats.LastError)
+			}
+		}
+	}
+}
+
+func loadFeed(config FeedConfig) ([]*net.IPNet, error) {
+	var reader io.ReadCloser
+	if config.URL != "" {
+		client := http.Client{
+			Timeout: time.Duration(Timeout) * time.Second,
+		}
+		resp, err := client.Get(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, errors.Errorf("failed fetch %s, status: %s", config.URL, resp.Status)
+		}
+		reader = resp.Body
+	} else {
+		f, err := os.Open(config.File)
+		if err != nil {
+			return nil, err
+		}
+		reader = f
+	}
+	defer reader.Close()
+
+	if config.Format == FeedFormatJSON {
+		return readJSONFeed(reader)
+	}
+	return iptrie.ReadPrefixes(reader)
+}
+
+// readJSONFeed reads a json array of ip addresses or CIDRs, the elements may also be
+// objects with an ip, cidr or network field.
+func readJSONFeed(reader io.Reader) ([]*net.IPNet, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&items); err != nil {
+		return nil, err
+	}
+	var prefixes []*net.IPNet
+	for _, item := range items {
+		var value string
+		if err := json.Unmarshal(item, &value); err != nil {
+			var object struct {
+				IP      string `json:"ip"`
+				CIDR    string `json:"cidr"`
+				Network string `json:"network"`
+			}
+			if err := json.Unmarshal(item, &object); err != nil {
+				return nil, err
+			}
+			value = object.IP + object.CIDR + object.Network
+		}
+		prefix, err := iptrie.ParsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
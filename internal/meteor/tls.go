@@ -0,0 +1,142 @@
+package meteor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TLS terminates tls on the listener of a tcp forwarder, the backends receive plaintext.
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, 1.2 by default
+	MinVersion string `yaml:"min_version"`
+	// Ciphers is the list of the TLS 1.0-1.2 cipher suite names, the Go defaults when empty
+	Ciphers []string `yaml:"ciphers"`
+	// ClientCA requires the clients to present a certificate signed by one of the CAs of the file
+	ClientCA string `yaml:"client_ca"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1":   tls.VersionTLS10,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newTLSTerminator(config TLS) (*tlsTerminator, error) {
+	if config.Cert == "" || config.Key == "" {
+		return nil, errors.New("cert and key are required")
+	}
+	if config.MinVersion == "" {
+		config.MinVersion = "1.2"
+	}
+	minVersion, ok := tlsVersions[config.MinVersion]
+	if !ok {
+		return nil, errors.Errorf("invalid tls min version %q", config.MinVersion)
+	}
+	ciphers, err := parseCipherSuites(config.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+	terminator := tlsTerminator{
+		config:     config,
+		minVersion: minVersion,
+		ciphers:    ciphers,
+	}
+	if err := terminator.Reload(); err != nil {
+		return nil, err
+	}
+	return &terminator, nil
+}
+
+type tlsTerminator struct {
+	config     TLS
+	minVersion uint16
+	ciphers    []uint16
+	// tlsConfig is swapped by Reload, so that the new handshakes use the new certificate
+	tlsConfig atomic.Pointer[tls.Config]
+}
+
+// Reload loads the certificate and the client CAs again, the current ones are kept on error.
+func (r *tlsTerminator) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.config.Cert, r.config.Key)
+	if err != nil {
+		return errors.Wrap(err, "failed load tls certificate")
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   r.minVersion,
+		CipherSuites: r.ciphers,
+	}
+	if r.config.ClientCA != "" {
+		pem, err := os.ReadFile(r.config.ClientCA)
+		if err != nil {
+			return errors.Wrap(err, "failed read tls client ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificate found in %s", r.config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.tlsConfig.Store(tlsConfig)
+	return nil
+}
+
+func (r *tlsTerminator) Files() []string {
+	files := []string{r.config.Cert, r.config.Key}
+	if r.config.ClientCA != "" {
+		files = append(files, r.config.ClientCA)
+	}
+	return files
+}
+
+// Listener wraps ln, the handshakes take place on the first read or write of the connections.
+func (r *tlsTerminator) Listener(ln net.Listener) net.Listener {
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.tlsConfig.Load(), nil
+		},
+	})
+}
+
+// Handshake completes the handshake of conn accepted by Listener within Timeout seconds.
+func (r *tlsTerminator) Handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	var ciphers []uint16
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, errors.Errorf("invalid tls cipher %q", name)
+		}
+		ciphers = append(ciphers, id)
+	}
+	return ciphers, nil
+}
@@ -0,0 +1,71 @@
+package filewatch
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/dushxiiang/meteor/pkg/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Delay is how long Watch waits for the writes to a file to settle before reloading.
+var Delay = time.Second
+
+// Watch calls reload when any of the files changes until ctx is done, name describes the files in logs.
+// The directories are watched instead of the files, so that the files replaced by rename are picked up as well.
+func Watch(ctx context.Context, name string, files []string, reload func() error) {
+	sugar := logger.L.Sugar()
+	watched := make(map[string]struct{})
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err == nil {
+			watched[abs] = struct{}{}
+		}
+	}
+	if len(watched) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		sugar.Warnf("error creating %s file watcher: %v", name, err)
+		return
+	}
+	defer watcher.Close()
+
+	for file := range watched {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			sugar.Warnf("error watching %s file %s: %v", name, file, err)
+		}
+	}
+
+	timer := time.NewTimer(Delay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if _, ok := watched[filepath.Clean(event.Name)]; !ok {
+				continue
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+				timer.Reset(Delay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			sugar.Warnf("%s file watcher err: %v", name, err)
+		case <-timer.C:
+			if err := reload(); err != nil {
+				sugar.Warnf("error reloading %s files: %v", name, err)
+				continue
+			}
+			sugar.Infof("Reloaded %s files", name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package iptrie
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Trie is a binary prefix trie of IPv4 and IPv6 networks.
+type Trie[T any] struct {
+	v4   *node[T]
+	v6   *node[T]
+	size int
+}
+
+type node[T any] struct {
+	children [2]*node[T]
+	values   []T
+}
+
+func New[T any]() *Trie[T] {
+	return &Trie[T]{
+		v4: &node[T]{},
+		v6: &node[T]{},
+	}
+}
+
+// Insert adds the value to the prefix, a prefix can hold more than one value.
+func (t *Trie[T]) Insert(prefix *net.IPNet, value T) {
+	ones, bits := prefix.Mask.Size()
+	root, key := t.root(prefix.IP)
+	if root == nil {
+		return
+	}
+	if bits == 8*net.IPv6len && len(key) == net.IPv4len {
+		// IPv4-mapped IPv6 prefix
+		if ones < 96 {
+			return
+		}
+		ones -= 96
+	}
+	n := root
+	for i := 0; i < ones; i++ {
+		b := bit(key, i)
+		if n.children[b] == nil {
+			n.children[b] = &node[T]{}
+		}
+		n = n.children[b]
+	}
+	n.values = append(n.values, value)
+	t.size++
+}
+
+// Len returns the number of inserted values.
+func (t *Trie[T]) Len() int {
+	return t.size
+}
+
+// Match calls fn with the values of every prefix containing ip, from the shortest prefix to the longest.
+func (t *Trie[T]) Match(ip net.IP, fn func(values []T)) {
+	n, key := t.root(ip)
+	for i := 0; n != nil; i++ {
+		if len(n.values) > 0 {
+			fn(n.values)
+		}
+		if i == len(key)*8 {
+			return
+		}
+		n = n.children[bit(key, i)]
+	}
+}
+
+// Longest returns the values of the longest prefix containing ip.
+func (t *Trie[T]) Longest(ip net.IP) []T {
+	var values []T
+	t.Match(ip, func(v []T) {
+		values = v
+	})
+	return values
+}
+
+func (t *Trie[T]) root(ip net.IP) (*node[T], []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, ip4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return t.v6, ip16
+	}
+	return nil, nil
+}
+
+func bit(key []byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// ParsePrefix parses a CIDR or a single IP address as a prefix.
+func ParsePrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, prefix, err := net.ParseCIDR(s)
+		return prefix, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.Errorf("invalid ip address %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// ReadPrefixes reads one CIDR or ip address per line, the empty lines and the comments
+// starting with # or ; are ignored, as well as anything after the first field of a line.
+func ReadPrefixes(reader io.Reader) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		prefix, err := ParsePrefix(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, scanner.Err()
+}